@@ -56,7 +56,7 @@ function App() {
 
   useEffect(() => {
     const fetchUserData = async () => {
-      // Check URL for session ID first
+      // Servers running with SESSION_QUERY_PARAM also put the session ID in the URL
       const urlParams = new URLSearchParams(window.location.search);
       const sessionId = urlParams.get('session_id');
 
@@ -66,18 +66,17 @@ function App() {
         window.history.replaceState({}, document.title, window.location.pathname);
       }
 
-      let authed = (sessionId || localStorage.getItem('session_id')) ? true : false;
-      if (authed) {
-        try {
-          const profile = await getUserProfile();
-          setUserProfile(profile);
-          handleFetchPlaylists();
-        } catch (error) {
-          console.error('Error fetching user profile:', error);
-          // If profile fetch fails, user might not be authenticated anymore
-          localStorage.removeItem('session_id');
-          authed = false;
-        }
+      // The session cookie can't be read from here, so ask the server whether we're logged in
+      let authed = true;
+      try {
+        const profile = await getUserProfile();
+        setUserProfile(profile);
+        handleFetchPlaylists();
+      } catch (error) {
+        console.error('Error fetching user profile:', error);
+        // If profile fetch fails, user might not be authenticated anymore
+        localStorage.removeItem('session_id');
+        authed = false;
       }
       setIsAuthenticated(authed);
     };
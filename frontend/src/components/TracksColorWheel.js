@@ -7,36 +7,6 @@ const TracksColorWheel = ({ visible, onHide, tracks, playlistName, loading, full
   const [selectedTrack, setSelectedTrack] = useState(null);
   const [trackDetailsVisible, setTrackDetailsVisible] = useState(false);
 
-  // Convert RGB to HSV - we'll use this to position items on the color wheel
-  const rgbToHsv = (r, g, b) => {
-    r /= 255;
-    g /= 255;
-    b /= 255;
-
-    const max = Math.max(r, g, b);
-    const min = Math.min(r, g, b);
-    const delta = max - min;
-
-    let h = 0;
-    if (delta !== 0) {
-      if (max === r) {
-        h = ((g - b) / delta) % 6;
-      } else if (max === g) {
-        h = (b - r) / delta + 2;
-      } else {
-        h = (r - g) / delta + 4;
-      }
-    }
-
-    h = Math.round(h * 60);
-    if (h < 0) h += 360;
-
-    const s = max === 0 ? 0 : Math.round((delta / max) * 100);
-    const v = Math.round(max * 100);
-
-    return { h, s, v };
-  };
-
   // Draw the color wheel whenever tracks or canvas reference changes
   useEffect(() => {
     if (!visible || loading || !tracks || !tracks.length || !canvasRef.current) return;
@@ -57,7 +27,7 @@ const TracksColorWheel = ({ visible, onHide, tracks, playlistName, loading, full
     const albumMap = new Map();
 
     tracks.forEach(item => {
-      if (!item.track || !item.commonColor || !item.track.album.images.length) {
+      if (!item.track || item.unavailable || !item.commonColor || !item.track.album.images.length) {
         return;
       }
 
@@ -77,12 +47,12 @@ const TracksColorWheel = ({ visible, onHide, tracks, playlistName, loading, full
 
     // Calculate initial positions for unique album covers
     const positionInfo = uniqueTracks.map(item => {
-      const { R, G, B } = item.avgColor;
-      const { h, s, v } = rgbToHsv(R, G, B);
+      // HSV comes precomputed from the server (hue in degrees, saturation/value in 0-1)
+      const { h, s, v } = item.avgHsv;
 
       // Convert HSV to position
       const angle = h * Math.PI / 180;
-      const distance = (s / 100) * maxRadius;
+      const distance = s * maxRadius;
 
       // Calculate position on canvas
       const x = centerX + distance * Math.cos(angle);
@@ -1,10 +1,18 @@
 // Use environment variable with fallback value for local development
 export const API_BASE = process.env.REACT_APP_API_BASE || 'http://localhost:3026'
 
+// The session rides in an HttpOnly cookie. Servers running with SESSION_QUERY_PARAM
+// still hand out a session_id in the URL, so keep passing it along when we have one.
+const sessionQuery = (params = new URLSearchParams()) => {
+    const sessionId = localStorage.getItem('session_id');
+    if (sessionId) params.set('session_id', sessionId);
+    const query = params.toString();
+    return query ? `?${query}` : '';
+};
+
 export const getUserProfile = async () => {
     try {
-        const sessionId = localStorage.getItem('session_id');
-        const response = await fetch(`${API_BASE}/user?session_id=${sessionId}`, {
+        const response = await fetch(`${API_BASE}/user${sessionQuery()}`, {
             method: 'GET',
             credentials: 'include',
             headers: {
@@ -25,10 +33,7 @@ export const getUserProfile = async () => {
 
 export const logoutUser = async () => {
     try {
-        const sessionId = localStorage.getItem('session_id');
-        if (!sessionId) return;
-
-        const response = await fetch(`${API_BASE}/logout?session_id=${sessionId}`, {
+        const response = await fetch(`${API_BASE}/logout${sessionQuery()}`, {
             method: 'POST',
             credentials: 'include',
         });
@@ -46,10 +51,7 @@ export const logoutUser = async () => {
 
 export const getUserPlaylists = async () => {
     try {
-        const sessionId = localStorage.getItem('session_id');
-        if (!sessionId) throw new Error('No session ID found');
-
-        const response = await fetch(`${API_BASE}/data?session_id=${sessionId}`, {
+        const response = await fetch(`${API_BASE}/data${sessionQuery()}`, {
             method: 'GET',
             credentials: 'include',
             headers: {
@@ -70,11 +72,10 @@ export const getUserPlaylists = async () => {
 
 export const getPlaylistTracks = async (playlistId) => {
     try {
-        const sessionId = localStorage.getItem('session_id');
-        if (!sessionId) throw new Error('No session ID found');
+        // Public playlists load without a session, the server falls back to its app token
         if (!playlistId) throw new Error('No playlist ID provided');
 
-        const response = await fetch(`${API_BASE}/playlist/${playlistId}?session_id=${sessionId}`, {
+        const response = await fetch(`${API_BASE}/playlist/${playlistId}${sessionQuery()}`, {
             method: 'GET',
             credentials: 'include',
             headers: {
@@ -93,10 +94,55 @@ export const getPlaylistTracks = async (playlistId) => {
     }
 };
 
+// Streams processed tracks as they are ready, calling onItem for each one.
+// Resolves with the final summary once the server sends its "done" event.
+export const streamPlaylistTracks = (playlistId, onItem) => {
+    return new Promise((resolve, reject) => {
+        if (!playlistId) return reject(new Error('No playlist ID provided'));
+
+        const source = new EventSource(`${API_BASE}/playlist/${playlistId}/stream${sessionQuery()}`, {
+            withCredentials: true,
+        });
+
+        source.addEventListener('item', (event) => onItem(JSON.parse(event.data)));
+        source.addEventListener('done', (event) => {
+            source.close();
+            resolve(JSON.parse(event.data));
+        });
+        source.addEventListener('error', (event) => {
+            source.close();
+            console.error('Error streaming playlist tracks:', event);
+            reject(new Error('Playlist stream failed'));
+        });
+    });
+};
+
+// Resolves an open.spotify.com URL, spotify:playlist: URI or bare ID to playlist metadata.
+// Works without a session for public playlists.
+export const resolvePlaylist = async (query) => {
+    try {
+        const params = new URLSearchParams({ q: query });
+        const response = await fetch(`${API_BASE}/resolve${sessionQuery(params)}`, {
+            method: 'GET',
+            credentials: 'include',
+            headers: {
+                'Content-Type': 'application/json',
+            },
+        });
+
+        if (!response.ok) {
+            throw new Error(`HTTP response error: ${response.status}`);
+        }
+
+        return await response.json();
+    } catch (error) {
+        console.error('Error resolving playlist:', error);
+        throw error;
+    }
+};
+
 export const getPlaylistDetails = async (playlistId) => {
     try {
-        const sessionId = localStorage.getItem('session_id');
-        if (!sessionId) throw new Error('No session ID found');
         if (!playlistId) throw new Error('No playlist ID provided');
 
         // Get playlist data from storage
@@ -111,11 +157,101 @@ export const getPlaylistDetails = async (playlistId) => {
             }
         }
 
-        console.log('PLAYLIST NOT FOUND IN STORAGE: ', playlistId);
-        console.log('Returning null (TODO: Implement API call to fetch playlist details)');
-        return null;
+        // Not one of the user's playlists, so look it up on the server
+        return await resolvePlaylist(playlistId);
     } catch (error) {
         console.error('Error fetching playlist details:', error);
         throw error;
     }
 };
+
+// Fetches JSON from one of the session-aware collection endpoints, such as
+// /library/albums, /library/tracks, /artist/{id}, /album/{id} or /top
+const getCollectionItems = async (path, query = {}) => {
+    try {
+        const response = await fetch(`${API_BASE}${path}${sessionQuery(new URLSearchParams(query))}`, {
+            method: 'GET',
+            credentials: 'include',
+            headers: {
+                'Content-Type': 'application/json',
+            },
+        });
+
+        if (!response.ok) {
+            throw new Error(`HTTP response error: ${response.status}`);
+        }
+
+        return await response.json();
+    } catch (error) {
+        console.error(`Error fetching ${path}:`, error);
+        throw error;
+    }
+};
+
+export const getSavedAlbums = () => getCollectionItems('/library/albums');
+export const getSavedTracks = () => getCollectionItems('/library/tracks');
+export const getArtistAlbums = (artistId) => getCollectionItems(`/artist/${encodeURIComponent(artistId)}`);
+export const getAlbumTracks = (albumId) => getCollectionItems(`/album/${encodeURIComponent(albumId)}`);
+
+// Fetches the user's top tracks and artists with an aggregate palette for each time
+// range (short_term, medium_term, long_term), or just the one given
+export const getTopColors = (timeRange) =>
+    getCollectionItems('/top', timeRange ? { time_range: timeRange } : {});
+
+// Fetches recently played tracks with their colors, bucketed by 'hour' or 'day' in
+// the browser's time zone
+export const getRecentColors = (bucket = 'hour') =>
+    getCollectionItems('/recent', {
+        bucket,
+        tz: Intl.DateTimeFormat().resolvedOptions().timeZone,
+    });
+
+// Follows what the user is playing. onUpdate gets a { isPlaying, progressMs, durationMs, item }
+// object whenever the track changes or playback starts or stops. Returns a function
+// that closes the stream.
+export const streamNowPlaying = (onUpdate, onError) => {
+    const source = new EventSource(`${API_BASE}/now-playing${sessionQuery()}`, {
+        withCredentials: true,
+    });
+
+    source.addEventListener('now-playing', (event) => onUpdate(JSON.parse(event.data)));
+    source.addEventListener('error', (event) => {
+        // Events sent by the server end the stream, connection drops are retried by EventSource
+        if (event.data) {
+            source.close();
+            console.error('Now playing stream failed:', event.data);
+            if (onError) onError(JSON.parse(event.data));
+        }
+    });
+
+    return () => source.close();
+};
+
+// Creates a copy of a playlist in the user's account with the tracks sorted by color.
+// sort is 'hue', 'rainbow' or 'lightness'. Resolves to the new playlist.
+export const createSortedPlaylist = async (playlistId, { sort = 'hue', color = 'avg', name, isPublic = false } = {}) => {
+    try {
+        if (!playlistId) throw new Error('No playlist ID provided');
+
+        const params = new URLSearchParams({ sort, color, public: String(isPublic) });
+        if (name) params.set('name', name);
+
+        const response = await fetch(`${API_BASE}/playlist/${playlistId}/sorted${sessionQuery(params)}`, {
+            method: 'POST',
+            credentials: 'include',
+        });
+
+        if (!response.ok) {
+            // A copy that couldn't be filled comes back with its ID so it can be linked to
+            const body = await response.json().catch(() => ({}));
+            const error = new Error(body.error || `HTTP response error: ${response.status}`);
+            error.playlistId = body.playlistId;
+            throw error;
+        }
+
+        return await response.json();
+    } catch (error) {
+        console.error('Error creating sorted playlist:', error);
+        throw error;
+    }
+};
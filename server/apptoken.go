@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	// AppTokenRefreshMargin is how long before expiry the app token is replaced
+	AppTokenRefreshMargin = 5 * time.Minute
+	// appTokenRetryDelay is how long the background refresher waits after a failure
+	appTokenRetryDelay = 30 * time.Second
+)
+
+// appTokens is the client-credentials token shared by every request without a session
+var appTokens = NewAppTokenSource(RequestClientCredentialsToken)
+
+// appTokensEnabled is set at startup when there is a client secret. The client
+// credentials flow needs one, so PKCE-only deployments serve logged in users only.
+var appTokensEnabled bool
+
+// AppTokenSource holds a single app token that isn't tied to any user and keeps it
+// fresh, so anonymous visitors can read public data without each one fetching a token
+type AppTokenSource struct {
+	mu        sync.Mutex
+	fetch     func() (SpotifyTokenResponse, error)
+	token     string
+	expiresAt time.Time
+	// refreshing is closed when the fetch in flight finishes, nil when there is none
+	refreshing chan struct{}
+	// err is the result of the last fetch
+	err error
+}
+
+// NewAppTokenSource creates a source that gets new tokens from fetch
+func NewAppTokenSource(fetch func() (SpotifyTokenResponse, error)) *AppTokenSource {
+	return &AppTokenSource{fetch: fetch}
+}
+
+// Token returns the current app token. A token close to expiring is still served while
+// a new one is fetched in the background, callers only wait when there is no usable token.
+func (s *AppTokenSource) Token() (string, error) {
+	s.mu.Lock()
+	now := time.Now()
+	if s.token != "" && now.Before(s.expiresAt.Add(-AppTokenRefreshMargin)) {
+		token := s.token
+		s.mu.Unlock()
+		return token, nil
+	}
+	done := s.startRefreshLocked()
+	if s.token != "" && now.Before(s.expiresAt) {
+		token := s.token
+		s.mu.Unlock()
+		return token, nil
+	}
+	s.mu.Unlock()
+
+	<-done
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return "", s.err
+	}
+	return s.token, nil
+}
+
+// RunRefresher replaces the token shortly before it expires so requests never wait on it
+func (s *AppTokenSource) RunRefresher() {
+	for {
+		s.mu.Lock()
+		done := s.startRefreshLocked()
+		s.mu.Unlock()
+
+		<-done
+
+		s.mu.Lock()
+		err := s.err
+		next := time.Until(s.expiresAt.Add(-AppTokenRefreshMargin))
+		s.mu.Unlock()
+
+		if err != nil {
+			slog.Error("Error refreshing app token", "err", err)
+			next = appTokenRetryDelay
+		}
+		if next < appTokenRetryDelay {
+			next = appTokenRetryDelay
+		}
+		time.Sleep(next)
+	}
+}
+
+// startRefreshLocked starts a fetch unless one is already in flight, and returns the
+// channel that is closed when it finishes. The lock isn't held during the fetch.
+func (s *AppTokenSource) startRefreshLocked() chan struct{} {
+	if s.refreshing == nil {
+		s.refreshing = make(chan struct{})
+		go s.refresh(s.refreshing)
+	}
+	return s.refreshing
+}
+
+func (s *AppTokenSource) refresh(done chan struct{}) {
+	tokenResponse, err := s.fetch()
+	if err == nil && tokenResponse.AccessToken == "" {
+		err = fmt.Errorf("no access token in client credentials response")
+	}
+
+	s.mu.Lock()
+	if err == nil {
+		s.token = tokenResponse.AccessToken
+		s.expiresAt = time.Now().Add(time.Duration(tokenResponse.ExpiresIn) * time.Second)
+	}
+	s.err = err
+	s.refreshing = nil
+	s.mu.Unlock()
+
+	close(done)
+}
@@ -1,84 +1,230 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
 
-	"github.com/redis/go-redis/v9"
+const (
+	// DefaultCacheBackend is used when CACHE_BACKEND is not set
+	DefaultCacheBackend = "redis"
+	// DefaultCacheDBPath is the path to the bbolt color cache file
+	DefaultCacheDBPath = "colors.db"
+	// DefaultMemoryCacheSize is the number of albums held by the in-process cache
+	DefaultMemoryCacheSize = 10000
+	// DefaultCacheTTL is how long an album can go unused before its colors expire
+	DefaultCacheTTL = 30 * 24 * time.Hour
 )
 
 type CacheEntry struct {
-	AvgColor    string `json:"a"` // rgb hex strings
-	CommonColor string `json:"c"`
+	AvgColor    string              `json:"a"` // rgb hex strings
+	CommonColor string              `json:"c"`
+	Palette     []CachePaletteColor `json:"p,omitempty"`
+	// Version is the extractor version that produced the entry, filled in from the key on read
+	Version int `json:"-"`
+}
+type CachePaletteColor struct {
+	Color  string  `json:"h"` // rgb hex string
+	Weight float64 `json:"w"`
 }
 type CacheUpdate struct {
 	AlbumID string     `json:"album_id"`
 	Value   CacheEntry `json:"value"`
 }
 
-func GetCache(keys []string) ([]*CacheEntry, error) {
-	// Get keys from Redis
-	vals, err := rdb.MGet(ctx, keys...).Result()
-	if err == redis.Nil {
-		return make([]*CacheEntry, len(keys)), nil
-	} else if err != nil {
+// ColorCache stores the computed colors for albums, keyed by album ID
+type ColorCache interface {
+	// Get returns one entry per key, leaving a nil pointer for every miss
+	Get(keys []string) ([]*CacheEntry, error)
+	// Set stores all of the given updates
+	Set(updates []CacheUpdate) error
+	// Close releases any connections or files held by the cache
+	Close() error
+}
+
+// cacheWrites tracks SetCache calls still running in the background, so one-shot
+// commands can wait for them before closing the cache
+var cacheWrites sync.WaitGroup
+
+// CacheOptions bounds how long and how many album entries a ColorCache keeps
+type CacheOptions struct {
+	// TTL expires entries that haven't been read or written for this long, 0 disables expiry
+	TTL time.Duration
+	// MaxEntries caps the number of cached albums, evicting the least recently used, 0 is unbounded
+	MaxEntries int
+}
+
+// cacheOptionsFromEnv reads CACHE_TTL and CACHE_MAX_ENTRIES
+func cacheOptionsFromEnv() (CacheOptions, error) {
+	opts := CacheOptions{TTL: DefaultCacheTTL}
+
+	if raw := os.Getenv("CACHE_TTL"); raw != "" {
+		ttl, err := time.ParseDuration(raw)
+		if err != nil || ttl < 0 {
+			return opts, fmt.Errorf("invalid CACHE_TTL: %q", raw)
+		}
+		opts.TTL = ttl
+	}
+
+	if raw := os.Getenv("CACHE_MAX_ENTRIES"); raw != "" {
+		maxEntries, err := strconv.Atoi(raw)
+		if err != nil || maxEntries < 0 {
+			return opts, fmt.Errorf("invalid CACHE_MAX_ENTRIES: %q", raw)
+		}
+		opts.MaxEntries = maxEntries
+	}
+
+	return opts, nil
+}
+
+// NewColorCache builds the cache backend named by backend ("redis", "memory" or "bbolt")
+func NewColorCache(backend string) (ColorCache, error) {
+	if backend == "" {
+		backend = DefaultCacheBackend
+	}
+
+	opts, err := cacheOptionsFromEnv()
+	if err != nil {
 		return nil, err
 	}
 
-	// Initialize array of nil pointers
-	entries := make([]*CacheEntry, len(keys))
-	hitCount := 0
+	switch backend {
+	case "redis":
+		return NewRedisCache(os.Getenv("REDIS_URI"), opts)
+	case "memory":
+		// Never let the in-process cache grow without bound
+		if opts.MaxEntries == 0 {
+			opts.MaxEntries = DefaultMemoryCacheSize
+		}
+		return NewMemoryCache(opts), nil
+	case "bbolt":
+		path := os.Getenv("CACHE_DB_PATH")
+		if path == "" {
+			path = DefaultCacheDBPath
+		}
+		return NewBoltCache(path, opts)
+	default:
+		return nil, fmt.Errorf("unknown cache backend: %q", backend)
+	}
+}
 
-	// Unmarshal the cached entries
-	for i, v := range vals {
-		// If the key is not found, leave the pointer as nil in the output array
-		if v == nil {
-			continue
+// NewCacheEntry packs computed colors into the compact form stored in the cache
+func NewCacheEntry(avgColor Color, commonColor Color, palette []PaletteColor) CacheEntry {
+	cachedPalette := make([]CachePaletteColor, len(palette))
+	for i, p := range palette {
+		// Round the weights, full float precision isn't worth the bytes
+		cachedPalette[i] = CachePaletteColor{Color: p.Color.ToHex(), Weight: math.Round(p.Weight*1000) / 1000}
+	}
+
+	return CacheEntry{
+		AvgColor:    avgColor.ToHex(),
+		CommonColor: commonColor.ToHex(),
+		Palette:     cachedPalette,
+	}
+}
+
+// Colors unpacks a cache entry back into the colors it was built from
+func (e CacheEntry) Colors() (Color, Color, []PaletteColor) {
+	palette := make([]PaletteColor, len(e.Palette))
+	for i, p := range e.Palette {
+		palette[i] = PaletteColor{Color: HexToColor(p.Color), Weight: p.Weight}
+	}
+
+	return HexToColor(e.AvgColor), HexToColor(e.CommonColor), palette
+}
+
+// CacheKey namespaces an album ID under a color-extraction algorithm version.
+// Version 0 is the bare album ID used before keys were versioned.
+func CacheKey(albumID string, version int) string {
+	if version == 0 {
+		return albumID
+	}
+	return fmt.Sprintf("colors:v%d:%s", version, albumID)
+}
+
+// GetCache looks up the colors for each album ID. Albums missing from the current
+// ColorAlgorithmVersion fall back to entries from older versions, which are returned
+// with their Version set so the caller can decide to recompute them.
+func GetCache(albumIDs []string) ([]*CacheEntry, error) {
+	keys := make([]string, len(albumIDs))
+	for i, albumID := range albumIDs {
+		keys[i] = CacheKey(albumID, ColorAlgorithmVersion)
+	}
+
+	entries, err := colorCache.Get(keys)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry != nil {
+			entry.Version = ColorAlgorithmVersion
 		}
+	}
 
-		strVal, ok := v.(string)
-		if !ok {
+	// Look up every older version of whatever is still missing in a single batch, so a
+	// miss costs one more round trip however many versions there have been
+	staleCount := 0
+	missing := []int{}
+	legacyKeys := []string{}
+	for i, entry := range entries {
+		if entry != nil {
 			continue
 		}
+		missing = append(missing, i)
+		for version := ColorAlgorithmVersion - 1; version >= 0; version-- {
+			legacyKeys = append(legacyKeys, CacheKey(albumIDs[i], version))
+		}
+	}
+	if len(legacyKeys) > 0 {
+		legacyEntries, err := colorCache.Get(legacyKeys)
+		if err != nil {
+			return nil, err
+		}
 
-		// Parse the json string and then set the pointer in the output array
-		var entry CacheEntry
-		if err := json.Unmarshal([]byte(strVal), &entry); err != nil {
-			continue
+		// Keys are grouped per album, newest version first, so the first hit wins
+		for j, i := range missing {
+			for k := 0; k < ColorAlgorithmVersion; k++ {
+				if entry := legacyEntries[j*ColorAlgorithmVersion+k]; entry != nil {
+					entry.Version = ColorAlgorithmVersion - 1 - k
+					entries[i] = entry
+					staleCount++
+					break
+				}
+			}
+		}
+	}
+
+	hitCount := 0
+	for _, entry := range entries {
+		if entry != nil {
+			hitCount++
 		}
-		entries[i] = &entry
-		hitCount++
 	}
-	fmt.Println("hit count: ", hitCount)
+	slog.Debug("Read color cache", "keys", len(albumIDs), "hits", hitCount, "stale", staleCount)
 
 	return entries, nil
 }
 
+// SetCache stores the updates under the current ColorAlgorithmVersion
 func SetCache(cacheUpdates []CacheUpdate) error {
-	// Skip if there are no updates
-	if len(cacheUpdates) == 0 {
-		return nil
-	}
-
-	// Convert CacheEntry objs to stringified json
-	pairs := make([]interface{}, 0, len(cacheUpdates)*2)
+	// Drop the empty slots left behind for cache hits
+	updates := make([]CacheUpdate, 0, len(cacheUpdates))
 	for _, update := range cacheUpdates {
-		// Add ablum id to array
-		pairs = append(pairs, update.AlbumID)
-
-		// Add json string to array
-		jsonData, err := json.Marshal(update.Value)
-		if err != nil {
-			return err
+		if update.AlbumID != "" {
+			update.AlbumID = CacheKey(update.AlbumID, ColorAlgorithmVersion)
+			updates = append(updates, update)
 		}
-		pairs = append(pairs, string(jsonData))
 	}
 
-	// Set keys in Redis
-	err := rdb.MSet(ctx, pairs...).Err()
-	if err != nil {
-		return err
+	// Skip if there are no updates
+	if len(updates) == 0 {
+		return nil
 	}
 
-	return nil
+	return colorCache.Set(updates)
 }
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+const (
+	// ColorBucket is the name of the bucket to store album colors
+	ColorBucket = "colors"
+	// boltTouchInterval is the longest a read goes without bumping an entry's access time
+	boltTouchInterval = 1 * time.Hour
+	// boltLowWater is the fraction of MaxEntries that eviction trims the bucket down to
+	boltLowWater = 0.9
+)
+
+// BoltCache is a ColorCache persisted to a local bbolt file
+type BoltCache struct {
+	db   *bbolt.DB
+	opts CacheOptions
+
+	// mu serializes writes so count stays in step with the bucket
+	mu sync.Mutex
+	// count is the number of keys in the bucket as of the last committed write
+	count int
+}
+
+// boltCacheRecord wraps an entry with the last time it was read or written
+type boltCacheRecord struct {
+	Entry  CacheEntry `json:"e"`
+	UsedAt time.Time  `json:"u"`
+}
+
+// boltWrite tracks how many keys a write transaction adds or removes, since
+// bucket stats only reflect what has already been committed
+type boltWrite struct {
+	b     *bbolt.Bucket
+	added int
+}
+
+// NewBoltCache opens (or creates) the bbolt color cache at path
+func NewBoltCache(path string, opts CacheOptions) (*BoltCache, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("could not open cache db: %v", err)
+	}
+
+	// Create the colors bucket if it doesn't exist
+	err = db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(ColorBucket))
+		if err != nil {
+			return fmt.Errorf("could not create bucket: %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	c := &BoltCache{db: db, opts: opts}
+	err = db.View(func(tx *bbolt.Tx) error {
+		c.count = tx.Bucket([]byte(ColorBucket)).Stats().KeyN
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *BoltCache) Get(keys []string) ([]*CacheEntry, error) {
+	entries := make([]*CacheEntry, len(keys))
+	now := time.Now()
+	// Keys that have expired or whose access time is due for a bump
+	stale := []string{}
+
+	err := c.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(ColorBucket))
+		for i, key := range keys {
+			data := b.Get([]byte(key))
+			if data == nil {
+				continue
+			}
+
+			var record boltCacheRecord
+			if err := json.Unmarshal(data, &record); err != nil {
+				continue // Treat invalid entries as misses
+			}
+			if c.expired(record, now) {
+				stale = append(stale, key)
+				continue
+			}
+
+			if now.Sub(record.UsedAt) > c.touchInterval() {
+				stale = append(stale, key)
+			}
+			entry := record.Entry
+			entries[i] = &entry
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(stale) > 0 {
+		// The reads already succeeded, so a failed bump only costs LRU accuracy
+		if err := c.touch(stale, now); err != nil {
+			slog.Warn("Could not update cache access times", "error", err)
+		}
+	}
+
+	return entries, nil
+}
+
+func (c *BoltCache) Set(updates []CacheUpdate) error {
+	now := time.Now()
+
+	return c.update(func(w *boltWrite) error {
+		for _, update := range updates {
+			if err := w.put(update.AlbumID, boltCacheRecord{Entry: update.Value, UsedAt: now}); err != nil {
+				return err
+			}
+		}
+
+		if c.opts.MaxEntries > 0 && c.count+w.added > c.opts.MaxEntries {
+			return c.evict(w, now)
+		}
+		return nil
+	})
+}
+
+func (c *BoltCache) Close() error {
+	return c.db.Close()
+}
+
+// update runs fn in a write transaction and commits its change to the key count
+func (c *BoltCache) update(fn func(w *boltWrite) error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	w := &boltWrite{}
+	err := c.db.Update(func(tx *bbolt.Tx) error {
+		w.b = tx.Bucket([]byte(ColorBucket))
+		return fn(w)
+	})
+	if err != nil {
+		return err
+	}
+	c.count += w.added
+	return nil
+}
+
+// touch deletes the given keys if they have expired and bumps their access time
+// otherwise, all in one write transaction. Records are read again since a Set may
+// have replaced them after the caller looked.
+func (c *BoltCache) touch(keys []string, now time.Time) error {
+	return c.update(func(w *boltWrite) error {
+		for _, key := range keys {
+			data := w.b.Get([]byte(key))
+			if data == nil {
+				continue
+			}
+
+			var record boltCacheRecord
+			if err := json.Unmarshal(data, &record); err != nil {
+				continue
+			}
+			if c.expired(record, now) {
+				if err := w.delete(key); err != nil {
+					return err
+				}
+				continue
+			}
+			if now.Sub(record.UsedAt) > c.touchInterval() {
+				record.UsedAt = now
+				if err := w.put(key, record); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// touchInterval is how stale an access time can get before a read rewrites it.
+// Skipping fresher bumps keeps most reads out of write transactions.
+func (c *BoltCache) touchInterval() time.Duration {
+	if c.opts.TTL > 0 && c.opts.TTL/10 < boltTouchInterval {
+		return c.opts.TTL / 10
+	}
+	return boltTouchInterval
+}
+
+func (w *boltWrite) put(key string, record boltCacheRecord) error {
+	jsonData, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if w.b.Get([]byte(key)) == nil {
+		w.added++
+	}
+	return w.b.Put([]byte(key), jsonData)
+}
+
+func (w *boltWrite) delete(key string) error {
+	if w.b.Get([]byte(key)) != nil {
+		w.added--
+	}
+	return w.b.Delete([]byte(key))
+}
+
+func (c *BoltCache) expired(record boltCacheRecord, now time.Time) bool {
+	return c.opts.TTL > 0 && now.Sub(record.UsedAt) > c.opts.TTL
+}
+
+// evict deletes expired records and then the least recently used ones until the
+// bucket is down to boltLowWater of MaxEntries, so a full cache doesn't scan the
+// bucket again on every Set
+func (c *BoltCache) evict(w *boltWrite, now time.Time) error {
+	type keyAge struct {
+		key    string
+		usedAt time.Time
+	}
+	live := []keyAge{}
+	stale := []string{}
+
+	err := w.b.ForEach(func(k, v []byte) error {
+		var record boltCacheRecord
+		if err := json.Unmarshal(v, &record); err != nil || c.expired(record, now) {
+			stale = append(stale, string(k))
+			return nil
+		}
+		live = append(live, keyAge{key: string(k), usedAt: record.UsedAt})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Oldest first, so the front of the slice is what gets evicted
+	sort.Slice(live, func(i, j int) bool { return live[i].usedAt.Before(live[j].usedAt) })
+	target := int(float64(c.opts.MaxEntries) * boltLowWater)
+	for i := 0; i < len(live)-target; i++ {
+		stale = append(stale, live[i].key)
+	}
+
+	for _, key := range stale {
+		if err := w.delete(key); err != nil {
+			return err
+		}
+	}
+	slog.Debug("Evicted cache entries", "count", len(stale))
+
+	return nil
+}
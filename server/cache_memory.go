@@ -0,0 +1,101 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// MemoryCache is an in-process ColorCache that evicts the least recently used album once full
+type MemoryCache struct {
+	mu    sync.Mutex
+	opts  CacheOptions
+	order *list.List // front is most recently used
+	items map[string]*list.Element
+}
+
+type memoryCacheItem struct {
+	key    string
+	entry  CacheEntry
+	usedAt time.Time
+}
+
+// NewMemoryCache creates an LRU cache holding at most opts.MaxEntries albums
+func NewMemoryCache(opts CacheOptions) *MemoryCache {
+	return &MemoryCache{
+		opts:  opts,
+		order: list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+func (c *MemoryCache) Get(keys []string) ([]*CacheEntry, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	entries := make([]*CacheEntry, len(keys))
+	for i, key := range keys {
+		elem, ok := c.items[key]
+		if !ok {
+			continue
+		}
+
+		item := elem.Value.(*memoryCacheItem)
+		if c.expired(item, now) {
+			c.remove(elem)
+			continue
+		}
+		item.usedAt = now
+		c.order.MoveToFront(elem)
+
+		// Hand out a copy so callers can't mutate the cached value
+		entry := item.entry
+		entries[i] = &entry
+	}
+
+	return entries, nil
+}
+
+func (c *MemoryCache) Set(updates []CacheUpdate) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for _, update := range updates {
+		if elem, ok := c.items[update.AlbumID]; ok {
+			item := elem.Value.(*memoryCacheItem)
+			item.entry = update.Value
+			item.usedAt = now
+			c.order.MoveToFront(elem)
+			continue
+		}
+
+		c.items[update.AlbumID] = c.order.PushFront(&memoryCacheItem{key: update.AlbumID, entry: update.Value, usedAt: now})
+	}
+
+	// Expired items collect at the back of the list, so drop those first
+	for elem := c.order.Back(); elem != nil && c.expired(elem.Value.(*memoryCacheItem), now); elem = c.order.Back() {
+		c.remove(elem)
+	}
+
+	// Then evict the least recently used albums once over capacity
+	for c.opts.MaxEntries > 0 && c.order.Len() > c.opts.MaxEntries {
+		c.remove(c.order.Back())
+	}
+
+	return nil
+}
+
+func (c *MemoryCache) Close() error {
+	return nil
+}
+
+func (c *MemoryCache) expired(item *memoryCacheItem, now time.Time) bool {
+	return c.opts.TTL > 0 && now.Sub(item.usedAt) > c.opts.TTL
+}
+
+func (c *MemoryCache) remove(elem *list.Element) {
+	c.order.Remove(elem)
+	delete(c.items, elem.Value.(*memoryCacheItem).key)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// RedisLRUIndexKey is the sorted set of album IDs scored by their last access time
+	RedisLRUIndexKey = "colors:lru"
+)
+
+// RedisCache is a ColorCache backed by a Redis instance
+type RedisCache struct {
+	client *redis.Client
+	opts   CacheOptions
+}
+
+// NewRedisCache connects to the Redis instance at uri and verifies the connection
+func NewRedisCache(uri string, opts CacheOptions) (*RedisCache, error) {
+	opt, err := redis.ParseURL(uri)
+	if err != nil {
+		return nil, fmt.Errorf("invalid REDIS_URI: %v", err)
+	}
+	client := redis.NewClient(opt)
+
+	// Test Redis connection
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to connect to Redis: %v", err)
+	}
+	slog.Info("Connected to Redis")
+
+	return &RedisCache{client: client, opts: opts}, nil
+}
+
+func (c *RedisCache) Get(keys []string) ([]*CacheEntry, error) {
+	// Get keys from Redis
+	vals, err := c.client.MGet(ctx, keys...).Result()
+	if err == redis.Nil {
+		return make([]*CacheEntry, len(keys)), nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	// Initialize array of nil pointers
+	entries := make([]*CacheEntry, len(keys))
+	hits := []string{}
+
+	// Unmarshal the cached entries
+	for i, v := range vals {
+		// If the key is not found, leave the pointer as nil in the output array
+		if v == nil {
+			continue
+		}
+
+		strVal, ok := v.(string)
+		if !ok {
+			continue
+		}
+
+		// Parse the json string and then set the pointer in the output array
+		var entry CacheEntry
+		if err := json.Unmarshal([]byte(strVal), &entry); err != nil {
+			continue
+		}
+		entries[i] = &entry
+		hits = append(hits, keys[i])
+	}
+
+	// Mark the hits as recently used, failing here shouldn't fail the lookup
+	if err := c.touch(hits); err != nil {
+		slog.Error("Error refreshing cache entries", "err", err)
+	}
+
+	return entries, nil
+}
+
+func (c *RedisCache) Set(updates []CacheUpdate) error {
+	now := float64(time.Now().Unix())
+
+	// Write every key with its own TTL and index it in a single round-trip
+	pipe := c.client.Pipeline()
+	for _, update := range updates {
+		jsonData, err := json.Marshal(update.Value)
+		if err != nil {
+			return err
+		}
+		pipe.Set(ctx, update.AlbumID, string(jsonData), c.opts.TTL)
+		pipe.ZAdd(ctx, RedisLRUIndexKey, redis.Z{Score: now, Member: update.AlbumID})
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+
+	return c.evict()
+}
+
+// touch slides the TTL and bumps the index score for keys that were just read
+func (c *RedisCache) touch(keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	now := float64(time.Now().Unix())
+	pipe := c.client.Pipeline()
+	for _, key := range keys {
+		if c.opts.TTL > 0 {
+			pipe.Expire(ctx, key, c.opts.TTL)
+		}
+		pipe.ZAddXX(ctx, RedisLRUIndexKey, redis.Z{Score: now, Member: key})
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// evict drops index members whose keys have expired and then trims the least
+// recently used albums until the cache is back under MaxEntries
+func (c *RedisCache) evict() error {
+	// Keys expire TTL after their last access, which is exactly their index score
+	if c.opts.TTL > 0 {
+		cutoff := time.Now().Add(-c.opts.TTL).Unix()
+		err := c.client.ZRemRangeByScore(ctx, RedisLRUIndexKey, "-inf", "("+strconv.FormatInt(cutoff, 10)).Err()
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.opts.MaxEntries == 0 {
+		return nil
+	}
+
+	count, err := c.client.ZCard(ctx, RedisLRUIndexKey).Result()
+	if err != nil {
+		return err
+	}
+	excess := count - int64(c.opts.MaxEntries)
+	if excess <= 0 {
+		return nil
+	}
+
+	oldest, err := c.client.ZPopMin(ctx, RedisLRUIndexKey, excess).Result()
+	if err != nil {
+		return err
+	}
+	evicted := make([]string, len(oldest))
+	for i, z := range oldest {
+		evicted[i] = z.Member.(string)
+	}
+	slog.Debug("Evicted cache entries", "count", len(evicted))
+
+	return c.client.Del(ctx, evicted...).Err()
+}
+
+func (c *RedisCache) Close() error {
+	return c.client.Close()
+}
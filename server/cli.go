@@ -0,0 +1,126 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// runPosterCommand renders a playlist's color wheel to a file.
+// Usage: spotify-vis poster -playlist <id> (-token <access token> | -session <session id>) [-out file] [options]
+func runPosterCommand(args []string) int {
+	defaults := DefaultPosterOptions()
+
+	flags := flag.NewFlagSet("poster", flag.ContinueOnError)
+	playlistID := flags.String("playlist", "", "Spotify playlist ID to render")
+	token := flags.String("token", "", "Spotify access token")
+	sessionID := flags.String("session", "", "session ID to read an access token from "+DBPath)
+	out := flags.String("out", "", "output file (default <playlist>.<format>)")
+	format := flags.String("format", defaults.Format, "output format: png or svg")
+	width := flags.Int("width", defaults.Width, "canvas width in pixels")
+	height := flags.Int("height", defaults.Height, "canvas height in pixels")
+	background := flags.String("background", defaults.Background, "background hex color")
+	colorMode := flags.String("color", defaults.ColorMode, "color that drives placement: avg or common")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	opts := PosterOptions{
+		Width:      *width,
+		Height:     *height,
+		Background: *background,
+		ColorMode:  *colorMode,
+		Format:     *format,
+	}
+	if err := opts.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if *playlistID == "" {
+		fmt.Fprintln(os.Stderr, "-playlist is required")
+		return 2
+	}
+
+	// Only set up what rendering needs, the server's required variables and
+	// databases are left alone
+	envErr := loadEnv()
+	if err := initLogging(); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to configure logging:", err)
+		return 1
+	}
+	if envErr != nil {
+		slog.Warn("Error loading .env file", "err", envErr)
+	}
+	if err := setupClients(); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to configure clients:", err)
+		return 1
+	}
+	colorCache = openCommandCache()
+	defer colorCache.Close()
+	// Colors are written to the cache in the background, so let them land before exiting
+	defer cacheWrites.Wait()
+
+	accessToken := *token
+	if accessToken == "" && *sessionID != "" {
+		// The session db is only opened when needed since a running server holds its lock
+		cipher, err := NewSessionCipher(os.Getenv("SESSION_ENCRYPTION_KEYS"))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to configure session encryption:", err)
+			return 1
+		}
+		sessionCipher = cipher
+		sessionDB, err := InitDB()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to open session database:", err)
+			return 1
+		}
+		session, err := GetSession(sessionDB, *sessionID)
+		sessionDB.Close()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to load session:", err)
+			return 1
+		}
+		accessToken = session.Token.AccessToken
+	}
+	if accessToken == "" {
+		fmt.Fprintln(os.Stderr, "one of -token or -session is required")
+		return 2
+	}
+
+	items, err := GetPlaylistItems(ctx, *playlistID, accessToken)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to fetch playlist tracks:", err)
+		return 1
+	}
+
+	path := *out
+	if path == "" {
+		path = fmt.Sprintf("%s.%s", *playlistID, opts.Format)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to create output file:", err)
+		return 1
+	}
+	defer file.Close()
+
+	if err := RenderPoster(ctx, file, items, opts); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to render poster:", err)
+		return 1
+	}
+	fmt.Printf("Wrote %d albums to %s\n", len(items), path)
+
+	return 0
+}
+
+// openCommandCache opens the configured color cache, falling back to an in-memory one
+// when it can't be reached, e.g. because a running server holds the bbolt file lock
+func openCommandCache() ColorCache {
+	cache, err := NewColorCache(os.Getenv("CACHE_BACKEND"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Color cache unavailable, colors won't be saved:", err)
+		return NewMemoryCache(CacheOptions{MaxEntries: DefaultMemoryCacheSize})
+	}
+	return cache
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"math"
+)
+
+// LinearRGB is a color with the sRGB gamma curve removed, channels in [0, 1]
+type LinearRGB struct {
+	R float64
+	G float64
+	B float64
+}
+
+// HSV is hue in degrees [0, 360) with saturation and value in [0, 1]
+type HSV struct {
+	H float64 `json:"h"`
+	S float64 `json:"s"`
+	V float64 `json:"v"`
+}
+
+// Lab is a CIELAB color relative to the D65 white point
+type Lab struct {
+	L float64 `json:"l"`
+	A float64 `json:"a"`
+	B float64 `json:"b"`
+}
+
+// OKLab is a point in the OKLab perceptual color space
+type OKLab struct {
+	L float64 `json:"l"`
+	A float64 `json:"a"`
+	B float64 `json:"b"`
+}
+
+// D65 reference white in XYZ
+const (
+	whiteX = 0.95047
+	whiteY = 1.00000
+	whiteZ = 1.08883
+)
+
+// ToLinear removes the sRGB gamma curve from each channel
+func (c Color) ToLinear() LinearRGB {
+	return LinearRGB{R: srgbToLinear(c.R), G: srgbToLinear(c.G), B: srgbToLinear(c.B)}
+}
+
+// ToColor applies the sRGB gamma curve and clamps back to 8-bit channels
+func (c LinearRGB) ToColor() Color {
+	return Color{R: linearToSRGB(c.R), G: linearToSRGB(c.G), B: linearToSRGB(c.B)}
+}
+
+// ToHSV converts the color to hue, saturation and value
+func (c Color) ToHSV() HSV {
+	r := float64(c.R) / 255
+	g := float64(c.G) / 255
+	b := float64(c.B) / 255
+
+	max := math.Max(r, math.Max(g, b))
+	min := math.Min(r, math.Min(g, b))
+	delta := max - min
+
+	h := 0.0
+	if delta != 0 {
+		switch max {
+		case r:
+			h = math.Mod((g-b)/delta, 6)
+		case g:
+			h = (b-r)/delta + 2
+		default:
+			h = (r-g)/delta + 4
+		}
+	}
+	h *= 60
+	if h < 0 {
+		h += 360
+	}
+
+	s := 0.0
+	if max != 0 {
+		s = delta / max
+	}
+
+	return HSV{H: h, S: s, V: max}
+}
+
+// ToLab converts the color to CIELAB (D65)
+func (c Color) ToLab() Lab {
+	lin := c.ToLinear()
+
+	x := (0.4124564*lin.R + 0.3575761*lin.G + 0.1804375*lin.B) / whiteX
+	y := (0.2126729*lin.R + 0.7151522*lin.G + 0.0721750*lin.B) / whiteY
+	z := (0.0193339*lin.R + 0.1191920*lin.G + 0.9503041*lin.B) / whiteZ
+
+	fx, fy, fz := labF(x), labF(y), labF(z)
+
+	return Lab{
+		L: 116*fy - 16,
+		A: 500 * (fx - fy),
+		B: 200 * (fy - fz),
+	}
+}
+
+// ToColor converts a CIELAB color back to the nearest sRGB color
+func (c Lab) ToColor() Color {
+	fy := (c.L + 16) / 116
+	fx := fy + c.A/500
+	fz := fy - c.B/200
+
+	x := labFInv(fx) * whiteX
+	y := labFInv(fy) * whiteY
+	z := labFInv(fz) * whiteZ
+
+	return LinearRGB{
+		R: 3.2404542*x - 1.5371385*y - 0.4985314*z,
+		G: -0.9692660*x + 1.8760108*y + 0.0415560*z,
+		B: 0.0556434*x - 0.2040259*y + 1.0572252*z,
+	}.ToColor()
+}
+
+// ToOKLab converts the color to OKLab
+func (c Color) ToOKLab() OKLab {
+	lin := c.ToLinear()
+
+	l := math.Cbrt(0.4122214708*lin.R + 0.5363325363*lin.G + 0.0514459929*lin.B)
+	m := math.Cbrt(0.2119034982*lin.R + 0.6806995451*lin.G + 0.1073969566*lin.B)
+	s := math.Cbrt(0.0883024619*lin.R + 0.2817188376*lin.G + 0.6299787005*lin.B)
+
+	return OKLab{
+		L: 0.2104542553*l + 0.7936177850*m - 0.0040720468*s,
+		A: 1.9779984951*l - 2.4285922050*m + 0.4505937099*s,
+		B: 0.0259040371*l + 0.7827717662*m - 0.8086757660*s,
+	}
+}
+
+// ToColor converts an OKLab point back to the nearest sRGB color
+func (c OKLab) ToColor() Color {
+	l := c.L + 0.3963377774*c.A + 0.2158037573*c.B
+	m := c.L - 0.1055613458*c.A - 0.0638541728*c.B
+	s := c.L - 0.0894841775*c.A - 1.2914855480*c.B
+	l, m, s = l*l*l, m*m*m, s*s*s
+
+	return LinearRGB{
+		R: 4.0767416621*l - 3.3077115913*m + 0.2309699292*s,
+		G: -1.2684380046*l + 2.6097574011*m - 0.3413193965*s,
+		B: -0.0041960863*l - 0.7034186147*m + 1.7076147010*s,
+	}.ToColor()
+}
+
+// AverageLinear averages colors in linear light, which keeps blends from darkening
+func AverageLinear(colors []Color) Color {
+	if len(colors) == 0 {
+		return Color{R: 0, G: 0, B: 0}
+	}
+
+	var sum LinearRGB
+	for _, c := range colors {
+		lin := c.ToLinear()
+		sum.R += lin.R
+		sum.G += lin.G
+		sum.B += lin.B
+	}
+	n := float64(len(colors))
+
+	return LinearRGB{R: sum.R / n, G: sum.G / n, B: sum.B / n}.ToColor()
+}
+
+// AverageOKLab averages colors in OKLab, giving a perceptually balanced mean
+func AverageOKLab(colors []Color) Color {
+	if len(colors) == 0 {
+		return Color{R: 0, G: 0, B: 0}
+	}
+
+	var sum OKLab
+	for _, c := range colors {
+		ok := c.ToOKLab()
+		sum.L += ok.L
+		sum.A += ok.A
+		sum.B += ok.B
+	}
+	n := float64(len(colors))
+
+	return OKLab{L: sum.L / n, A: sum.A / n, B: sum.B / n}.ToColor()
+}
+
+// DeltaE76 is the Euclidean distance between two CIELAB colors
+func DeltaE76(a, b Lab) float64 {
+	dl, da, db := a.L-b.L, a.A-b.A, a.B-b.B
+	return math.Sqrt(dl*dl + da*da + db*db)
+}
+
+// DeltaEOK is the Euclidean distance between two OKLab colors
+func DeltaEOK(a, b OKLab) float64 {
+	return math.Sqrt(okDistSq(a, b))
+}
+
+// DeltaE2000 is the CIEDE2000 color difference between two CIELAB colors
+func DeltaE2000(a, b Lab) float64 {
+	c1 := math.Hypot(a.A, a.B)
+	c2 := math.Hypot(b.A, b.B)
+	cBar := (c1 + c2) / 2
+
+	cBar7 := math.Pow(cBar, 7)
+	g := 0.5 * (1 - math.Sqrt(cBar7/(cBar7+math.Pow(25, 7))))
+
+	a1 := (1 + g) * a.A
+	a2 := (1 + g) * b.A
+	c1p := math.Hypot(a1, a.B)
+	c2p := math.Hypot(a2, b.B)
+	h1p := hueAngle(a.B, a1)
+	h2p := hueAngle(b.B, a2)
+
+	dLp := b.L - a.L
+	dCp := c2p - c1p
+
+	dhp := 0.0
+	if c1p*c2p != 0 {
+		dhp = h2p - h1p
+		if dhp > 180 {
+			dhp -= 360
+		} else if dhp < -180 {
+			dhp += 360
+		}
+	}
+	dHp := 2 * math.Sqrt(c1p*c2p) * math.Sin(degToRad(dhp/2))
+
+	lBarP := (a.L + b.L) / 2
+	cBarP := (c1p + c2p) / 2
+
+	hBarP := h1p + h2p
+	if c1p*c2p != 0 {
+		if math.Abs(h1p-h2p) > 180 {
+			if hBarP < 360 {
+				hBarP += 360
+			} else {
+				hBarP -= 360
+			}
+		}
+		hBarP /= 2
+	}
+
+	t := 1 - 0.17*math.Cos(degToRad(hBarP-30)) +
+		0.24*math.Cos(degToRad(2*hBarP)) +
+		0.32*math.Cos(degToRad(3*hBarP+6)) -
+		0.20*math.Cos(degToRad(4*hBarP-63))
+
+	dTheta := 30 * math.Exp(-math.Pow((hBarP-275)/25, 2))
+	cBarP7 := math.Pow(cBarP, 7)
+	rc := 2 * math.Sqrt(cBarP7/(cBarP7+math.Pow(25, 7)))
+	lBar50 := (lBarP - 50) * (lBarP - 50)
+	sl := 1 + 0.015*lBar50/math.Sqrt(20+lBar50)
+	sc := 1 + 0.045*cBarP
+	sh := 1 + 0.015*cBarP*t
+	rt := -math.Sin(degToRad(2*dTheta)) * rc
+
+	return math.Sqrt(
+		math.Pow(dLp/sl, 2) +
+			math.Pow(dCp/sc, 2) +
+			math.Pow(dHp/sh, 2) +
+			rt*(dCp/sc)*(dHp/sh))
+}
+
+func labF(t float64) float64 {
+	if t > 216.0/24389.0 {
+		return math.Cbrt(t)
+	}
+	return (24389.0/27.0*t + 16) / 116
+}
+
+func labFInv(t float64) float64 {
+	if t3 := t * t * t; t3 > 216.0/24389.0 {
+		return t3
+	}
+	return (116*t - 16) * 27.0 / 24389.0
+}
+
+// hueAngle returns atan2(y, x) in degrees [0, 360)
+func hueAngle(y, x float64) float64 {
+	if x == 0 && y == 0 {
+		return 0
+	}
+	h := math.Atan2(y, x) * 180 / math.Pi
+	if h < 0 {
+		h += 360
+	}
+	return h
+}
+
+func degToRad(d float64) float64 {
+	return d * math.Pi / 180
+}
+
+// srgbToLinear undoes the sRGB gamma curve for an 8-bit channel
+func srgbToLinear(v int) float64 {
+	c := float64(v) / 255
+	if c <= 0.04045 {
+		return c / 12.92
+	}
+	return math.Pow((c+0.055)/1.055, 2.4)
+}
+
+// linearToSRGB applies the sRGB gamma curve and clamps to an 8-bit channel
+func linearToSRGB(c float64) int {
+	if c <= 0.0031308 {
+		c *= 12.92
+	} else {
+		c = 1.055*math.Pow(c, 1/2.4) - 0.055
+	}
+	return int(math.Round(math.Max(0, math.Min(1, c)) * 255))
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"image"
+	"math"
+	"testing"
+)
+
+// everyFewColors calls fn for a grid of sRGB colors covering the whole cube
+func everyFewColors(fn func(c Color)) {
+	for r := 0; r <= 255; r += 15 {
+		for g := 0; g <= 255; g += 15 {
+			for b := 0; b <= 255; b += 15 {
+				fn(Color{R: r, G: g, B: b})
+			}
+		}
+	}
+}
+
+func TestLinearRoundTrip(t *testing.T) {
+	for v := 0; v <= 255; v++ {
+		c := Color{R: v, G: 255 - v, B: v / 2}
+		if got := c.ToLinear().ToColor(); got != c {
+			t.Errorf("linear round trip of %s gave %s", c.ToHex(), got.ToHex())
+		}
+	}
+}
+
+func TestLabRoundTrip(t *testing.T) {
+	everyFewColors(func(c Color) {
+		if got := c.ToLab().ToColor(); got != c {
+			t.Errorf("CIELAB round trip of %s gave %s", c.ToHex(), got.ToHex())
+		}
+	})
+}
+
+func TestOKLabRoundTrip(t *testing.T) {
+	everyFewColors(func(c Color) {
+		if got := c.ToOKLab().ToColor(); got != c {
+			t.Errorf("OKLab round trip of %s gave %s", c.ToHex(), got.ToHex())
+		}
+	})
+}
+
+func TestKnownConversions(t *testing.T) {
+	tests := []struct {
+		color Color
+		hsv   HSV
+		lab   Lab
+		oklab OKLab
+	}{
+		{Color{0, 0, 0}, HSV{0, 0, 0}, Lab{0, 0, 0}, OKLab{0, 0, 0}},
+		{Color{255, 255, 255}, HSV{0, 0, 1}, Lab{100, 0, 0}, OKLab{1, 0, 0}},
+		{Color{255, 0, 0}, HSV{0, 1, 1}, Lab{53.2408, 80.0925, 67.2032}, OKLab{0.6279, 0.2249, 0.1258}},
+		{Color{0, 255, 0}, HSV{120, 1, 1}, Lab{87.7347, -86.1827, 83.1793}, OKLab{0.8664, -0.2339, 0.1795}},
+		{Color{0, 0, 255}, HSV{240, 1, 1}, Lab{32.2970, 79.1875, -107.8602}, OKLab{0.4520, -0.0325, -0.3115}},
+	}
+
+	near := func(a, b, tolerance float64) bool { return math.Abs(a-b) <= tolerance }
+	for _, tt := range tests {
+		hsv := tt.color.ToHSV()
+		if !near(hsv.H, tt.hsv.H, 1e-9) || !near(hsv.S, tt.hsv.S, 1e-9) || !near(hsv.V, tt.hsv.V, 1e-9) {
+			t.Errorf("%s to HSV = %+v, want %+v", tt.color.ToHex(), hsv, tt.hsv)
+		}
+		lab := tt.color.ToLab()
+		if !near(lab.L, tt.lab.L, 1e-3) || !near(lab.A, tt.lab.A, 1e-3) || !near(lab.B, tt.lab.B, 1e-3) {
+			t.Errorf("%s to CIELAB = %+v, want %+v", tt.color.ToHex(), lab, tt.lab)
+		}
+		oklab := tt.color.ToOKLab()
+		if !near(oklab.L, tt.oklab.L, 1e-4) || !near(oklab.A, tt.oklab.A, 1e-4) || !near(oklab.B, tt.oklab.B, 1e-4) {
+			t.Errorf("%s to OKLab = %+v, want %+v", tt.color.ToHex(), oklab, tt.oklab)
+		}
+	}
+}
+
+func TestDeltaE76(t *testing.T) {
+	if got := DeltaE76(Lab{50, 0, 0}, Lab{53, 4, 0}); math.Abs(got-5) > 1e-12 {
+		t.Errorf("DeltaE76 = %v, want 5", got)
+	}
+	if got := DeltaEOK(OKLab{0.5, 0, 0}, OKLab{0.5, 0.03, 0.04}); math.Abs(got-0.05) > 1e-12 {
+		t.Errorf("DeltaEOK = %v, want 0.05", got)
+	}
+}
+
+// TestDeltaE2000 checks the reference pairs from Sharma, Wu and Dalal, "The CIEDE2000
+// color-difference formula: Implementation notes, supplementary test data, and
+// mathematical observations" (2005), Table 1
+func TestDeltaE2000(t *testing.T) {
+	tests := []struct {
+		a, b Lab
+		want float64
+	}{
+		{Lab{50.0000, 2.6772, -79.7751}, Lab{50.0000, 0.0000, -82.7485}, 2.0425},
+		{Lab{50.0000, 3.1571, -77.2803}, Lab{50.0000, 0.0000, -82.7485}, 2.8615},
+		{Lab{50.0000, 2.8361, -74.0200}, Lab{50.0000, 0.0000, -82.7485}, 3.4412},
+		{Lab{50.0000, -1.3802, -84.2814}, Lab{50.0000, 0.0000, -82.7485}, 1.0000},
+		{Lab{50.0000, -1.1848, -84.8006}, Lab{50.0000, 0.0000, -82.7485}, 1.0000},
+		{Lab{50.0000, -0.9009, -85.5211}, Lab{50.0000, 0.0000, -82.7485}, 1.0000},
+		{Lab{50.0000, 0.0000, 0.0000}, Lab{50.0000, -1.0000, 2.0000}, 2.3669},
+		{Lab{50.0000, -1.0000, 2.0000}, Lab{50.0000, 0.0000, 0.0000}, 2.3669},
+		{Lab{50.0000, 2.4900, -0.0010}, Lab{50.0000, -2.4900, 0.0009}, 7.1792},
+		{Lab{50.0000, 2.4900, -0.0010}, Lab{50.0000, -2.4900, 0.0010}, 7.1792},
+		{Lab{50.0000, 2.4900, -0.0010}, Lab{50.0000, -2.4900, 0.0011}, 7.2195},
+		{Lab{50.0000, 2.4900, -0.0010}, Lab{50.0000, -2.4900, 0.0012}, 7.2195},
+		{Lab{50.0000, -0.0010, 2.4900}, Lab{50.0000, 0.0009, -2.4900}, 4.8045},
+		{Lab{50.0000, -0.0010, 2.4900}, Lab{50.0000, 0.0010, -2.4900}, 4.8045},
+		{Lab{50.0000, -0.0010, 2.4900}, Lab{50.0000, 0.0011, -2.4900}, 4.7461},
+		{Lab{50.0000, 2.5000, 0.0000}, Lab{50.0000, 0.0000, -2.5000}, 4.3065},
+		{Lab{50.0000, 2.5000, 0.0000}, Lab{73.0000, 25.0000, -18.0000}, 27.1492},
+		{Lab{50.0000, 2.5000, 0.0000}, Lab{61.0000, -5.0000, 29.0000}, 22.8977},
+		{Lab{50.0000, 2.5000, 0.0000}, Lab{56.0000, -27.0000, -3.0000}, 31.9030},
+		{Lab{50.0000, 2.5000, 0.0000}, Lab{58.0000, 24.0000, 15.0000}, 19.4535},
+		{Lab{50.0000, 2.5000, 0.0000}, Lab{50.0000, 3.1736, 0.5854}, 1.0000},
+		{Lab{50.0000, 2.5000, 0.0000}, Lab{50.0000, 3.2972, 0.0000}, 1.0000},
+		{Lab{50.0000, 2.5000, 0.0000}, Lab{50.0000, 1.8634, 0.5757}, 1.0000},
+		{Lab{50.0000, 2.5000, 0.0000}, Lab{50.0000, 3.2592, 0.3350}, 1.0000},
+		{Lab{60.2574, -34.0099, 36.2677}, Lab{60.4626, -34.1751, 39.4387}, 1.2644},
+		{Lab{63.0109, -31.0961, -5.8663}, Lab{62.8187, -29.7946, -4.0864}, 1.2630},
+		{Lab{61.2901, 3.7196, -5.3901}, Lab{61.4292, 2.2480, -4.9620}, 1.8731},
+		{Lab{35.0831, -44.1164, 3.7933}, Lab{35.0232, -40.0716, 1.5901}, 1.8645},
+		{Lab{22.7233, 20.0904, -46.6940}, Lab{23.0331, 14.9730, -42.5619}, 2.0373},
+		{Lab{36.4612, 47.8580, 18.3852}, Lab{36.2715, 50.5065, 21.2231}, 1.4146},
+		{Lab{90.8027, -2.0831, 1.4410}, Lab{91.1528, -1.6435, 0.0447}, 1.4441},
+		{Lab{90.9257, -0.5406, -0.9208}, Lab{88.6381, -0.8985, -0.7239}, 1.5381},
+		{Lab{6.7747, -0.2908, -2.4247}, Lab{5.8714, -0.0985, -2.2286}, 0.6377},
+		{Lab{2.0776, 0.0795, -1.1350}, Lab{0.9033, -0.0636, -0.5514}, 0.9082},
+	}
+
+	for i, tt := range tests {
+		if got := DeltaE2000(tt.a, tt.b); math.Abs(got-tt.want) > 1e-4 {
+			t.Errorf("pair %d: DeltaE2000(%+v, %+v) = %.4f, want %.4f", i+1, tt.a, tt.b, got, tt.want)
+		}
+		// The formula is symmetric
+		if got := DeltaE2000(tt.b, tt.a); math.Abs(got-tt.want) > 1e-4 {
+			t.Errorf("pair %d reversed: DeltaE2000 = %.4f, want %.4f", i+1, got, tt.want)
+		}
+	}
+}
+
+func TestComputeAverageColorEmptyImage(t *testing.T) {
+	avgColor, commonColor := ComputeAverageColor(image.NewRGBA(image.Rect(0, 0, 0, 0)))
+
+	black := Color{R: 0, G: 0, B: 0}
+	if avgColor != black || commonColor != black {
+		t.Errorf("empty image gave %s and %s, want black", avgColor.ToHex(), commonColor.ToHex())
+	}
+}
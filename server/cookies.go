@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// sessionCookie carries the signed session ID
+const sessionCookie = "session"
+
+// allowSessionQueryParam reports whether the session_id query param is still accepted
+// and handed back by callback, for clients from before cookie sessions
+func allowSessionQueryParam() bool {
+	return os.Getenv("SESSION_QUERY_PARAM") == "true"
+}
+
+// cookieSameSite reads SESSION_COOKIE_SAMESITE. Lax suits a frontend served from the
+// same site as the API, none is needed when they are on different sites.
+func cookieSameSite() (http.SameSite, error) {
+	switch raw := os.Getenv("SESSION_COOKIE_SAMESITE"); strings.ToLower(raw) {
+	case "", "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	default:
+		return 0, fmt.Errorf("invalid SESSION_COOKIE_SAMESITE: %q", raw)
+	}
+}
+
+// cookieSecure reports whether cookies should only travel over HTTPS. Browsers
+// insist on it for SameSite=None cookies.
+func cookieSecure() bool {
+	if sameSite, _ := cookieSameSite(); sameSite == http.SameSiteNoneMode {
+		return true
+	}
+	return strings.HasPrefix(os.Getenv("REDIRECT_URI"), "https://")
+}
+
+// signSessionID appends an HMAC of the session ID keyed by SESSION_SECRET
+func signSessionID(sessionID string) string {
+	mac := hmac.New(sha256.New, []byte(os.Getenv("SESSION_SECRET")))
+	mac.Write([]byte(sessionID))
+	return sessionID + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifySessionCookie returns the session ID from a signed cookie value, or false
+// when the signature doesn't match
+func verifySessionCookie(value string) (string, bool) {
+	i := strings.LastIndex(value, ".")
+	if i < 0 {
+		return "", false
+	}
+	sessionID := value[:i]
+	if !hmac.Equal([]byte(signSessionID(sessionID)), []byte(value)) {
+		return "", false
+	}
+	return sessionID, true
+}
+
+// setSessionCookie hands the browser its signed session ID
+func setSessionCookie(w http.ResponseWriter, sessionID string) {
+	sameSite, _ := cookieSameSite()
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    signSessionID(sessionID),
+		Path:     "/",
+		MaxAge:   int(SessionExpiry.Seconds()),
+		HttpOnly: true,
+		Secure:   cookieSecure(),
+		SameSite: sameSite,
+	})
+}
+
+// renewSessionCookie pushes the cookie's expiry forward along with the session's
+// when GetSession renewed it
+func renewSessionCookie(w http.ResponseWriter, session *Session) {
+	if session.Renewed {
+		setSessionCookie(w, session.ID)
+	}
+}
+
+// clearSessionCookie removes the session cookie from the browser
+func clearSessionCookie(w http.ResponseWriter) {
+	sameSite, _ := cookieSameSite()
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   cookieSecure(),
+		SameSite: sameSite,
+	})
+}
+
+// sessionIDFromRequest returns the session ID from the signed session cookie, falling
+// back to the session_id query param when SESSION_QUERY_PARAM allows it. It returns
+// an empty string when the request has no valid session ID.
+func sessionIDFromRequest(r *http.Request) string {
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		if sessionID, ok := verifySessionCookie(cookie.Value); ok {
+			return sessionID
+		}
+		loggerFrom(r.Context()).Warn("Ignoring session cookie with a bad signature")
+	}
+
+	if allowSessionQueryParam() {
+		return r.URL.Query().Get("session_id")
+	}
+	return ""
+}
+
+// withOriginCheck rejects state-changing requests that don't come from the frontend.
+// The session cookie goes along with cross-site requests when SameSite=None, and a
+// query-only POST needs no preflight, so any page could otherwise act for the user.
+func withOriginCheck(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET", "HEAD", "OPTIONS":
+		default:
+			if !trustedOrigin(r) {
+				loggerFrom(r.Context()).Warn("Rejecting cross-site request", "origin", r.Header.Get("Origin"), "referer", r.Header.Get("Referer"))
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte(`{"error": "Cross-site request rejected"}`))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// trustedOrigin reports whether the request's Origin, or its Referer when there is no
+// Origin, is FRONTEND_URL or the server itself. Requests with neither are rejected.
+func trustedOrigin(r *http.Request) bool {
+	source := r.Header.Get("Origin")
+	if source == "" {
+		source = r.Header.Get("Referer")
+	}
+	sourceURL, err := url.Parse(source)
+	if err != nil || sourceURL.Host == "" {
+		return false
+	}
+
+	if frontendURL, err := url.Parse(os.Getenv("FRONTEND_URL")); err == nil &&
+		sourceURL.Scheme == frontendURL.Scheme && sourceURL.Host == frontendURL.Host {
+		return true
+	}
+	// The bundled frontend is served by this server, so its requests are same-origin
+	return sourceURL.Host == r.Host
+}
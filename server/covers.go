@@ -0,0 +1,69 @@
+package main
+
+import (
+	"container/list"
+	"image"
+	"sync"
+)
+
+const (
+	// DefaultCoverStoreSize is how many decoded covers are kept in memory
+	DefaultCoverStoreSize = 2000
+)
+
+// coverStore keeps recently decoded covers so rendering doesn't download them again
+var coverStore = NewCoverStore(DefaultCoverStoreSize)
+
+// CoverStore is an in-memory LRU of decoded cover images keyed by URL
+type CoverStore struct {
+	mu       sync.Mutex
+	capacity int
+	order    *list.List // front is most recently used
+	items    map[string]*list.Element
+}
+
+type coverStoreItem struct {
+	url string
+	img image.Image
+}
+
+// NewCoverStore creates a store holding at most capacity covers
+func NewCoverStore(capacity int) *CoverStore {
+	return &CoverStore{
+		capacity: capacity,
+		order:    list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// Get returns the cover for url if it is still held
+func (s *CoverStore) Get(url string) (image.Image, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elem, ok := s.items[url]
+	if !ok {
+		return nil, false
+	}
+	s.order.MoveToFront(elem)
+	return elem.Value.(*coverStoreItem).img, true
+}
+
+// Put stores a cover, evicting the least recently used one once full
+func (s *CoverStore) Put(url string, img image.Image) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if elem, ok := s.items[url]; ok {
+		elem.Value.(*coverStoreItem).img = img
+		s.order.MoveToFront(elem)
+		return
+	}
+
+	s.items[url] = s.order.PushFront(&coverStoreItem{url: url, img: img})
+	for s.order.Len() > s.capacity {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.items, oldest.Value.(*coverStoreItem).url)
+	}
+}
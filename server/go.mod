@@ -4,11 +4,14 @@ go 1.23
 
 toolchain go1.23.7
 
+require (
+	github.com/joho/godotenv v1.5.1
+	github.com/redis/go-redis/v9 v9.7.3
+	go.etcd.io/bbolt v1.4.0
+)
+
 require (
 	github.com/cespare/xxhash/v2 v2.2.0 // indirect
 	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
-	github.com/joho/godotenv v1.5.1 // indirect
-	github.com/redis/go-redis/v9 v9.7.3 // indirect
-	go.etcd.io/bbolt v1.4.0 // indirect
 	golang.org/x/sys v0.29.0 // indirect
 )
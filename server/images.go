@@ -1,15 +1,29 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"image"
 	_ "image/gif"
 	_ "image/jpeg"
 	_ "image/png"
-	"log"
 	"net/http"
+	"time"
 )
 
+// ColorAlgorithmVersion identifies the output of ComputeAverageColor in cache keys.
+// Bump it whenever the extraction changes (quantization, grayscale threshold, etc.)
+// so stale cached colors get recomputed instead of served forever.
+const ColorAlgorithmVersion = 4
+
+const (
+	// DefaultImageFetchTimeout bounds a single cover download
+	DefaultImageFetchTimeout = 10 * time.Second
+)
+
+// imageClient is shared by every cover download so connections to the CDN are reused
+var imageClient = &http.Client{Timeout: DefaultImageFetchTimeout}
+
 // ImageInfo holds basic information about an image
 type Color struct {
 	R int
@@ -41,42 +55,63 @@ func HexToColor(hex string) Color {
 
 
 
-// Download the image and then pass along to compute the main color
-func ProcessImage(spotifyImage *SpotifyImage) (Color, Color) {
-	if spotifyImage.URL == "" {
-		return Color{R: 0, G: 0, B: 0}, Color{R: 0, G: 0, B: 0}
+// Download the image and then pass along to compute the main colors and palette.
+// Returns an error when there is no cover or it couldn't be loaded, so callers don't
+// mistake a missing cover for a black one.
+func ProcessImage(ctx context.Context, spotifyImage *SpotifyImage) (Color, Color, []PaletteColor, error) {
+	if spotifyImage == nil || spotifyImage.URL == "" {
+		return Color{}, Color{}, nil, fmt.Errorf("album has no cover image")
 	}
 
-	// Make an HTTP request to get the image
-	resp, err := http.Get(spotifyImage.URL)
+	img, err := FetchCover(ctx, spotifyImage.URL)
 	if err != nil {
-		log.Printf("Error fetching image %s: %v", spotifyImage.URL, err)
-		return Color{R: 0, G: 0, B: 0}, Color{R: 0, G: 0, B: 0}
+		return Color{}, Color{}, nil, fmt.Errorf("error fetching image %s: %v", spotifyImage.URL, err)
+	}
+
+	// Compute the average color of the image
+	avgColor, commonColor := ComputeAverageColor(img)
+
+	// Compute the dominant colors for multi-hued covers
+	palette := ComputePalette(img, PaletteSize)
+
+	return avgColor, commonColor, palette, nil
+}
+
+// FetchCover returns the decoded cover at url, reusing covers that were already downloaded
+func FetchCover(ctx context.Context, url string) (image.Image, error) {
+	if img, ok := coverStore.Get(url); ok {
+		return img, nil
+	}
+
+	// Make an HTTP request to get the image, abandoned if ctx is cancelled
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := imageClient.Do(req)
+	if err != nil {
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	// Check if the response was successful
 	if resp.StatusCode != http.StatusOK {
-		log.Printf("Non-200 status code fetching image %s: %d", spotifyImage.URL, resp.StatusCode)
-		return Color{R: 0, G: 0, B: 0}, Color{R: 0, G: 0, B: 0}
+		return nil, fmt.Errorf("non-200 status code: %d", resp.StatusCode)
 	}
 
 	// Try to decode the image
 	img, _, err := image.Decode(resp.Body)
 	if err != nil {
-		log.Printf("Error decoding image %s: %v", spotifyImage.URL, err)
-		return Color{R: 0, G: 0, B: 0}, Color{R: 0, G: 0, B: 0}
+		return nil, fmt.Errorf("error decoding image: %v", err)
 	}
+	coverStore.Put(url, img)
 
-	// Compute the average color of the image
-	avgColor, commonColor := ComputeAverageColor(img)
-
-	return avgColor, commonColor
+	return img, nil
 }
 
 func ComputeAverageColor(img image.Image) (Color, Color) {
 	bounds := img.Bounds()
-	totalR, totalG, totalB := 0, 0, 0
+	var total OKLab
 	count := 0
 	rbit := 3
 
@@ -85,20 +120,25 @@ func ComputeAverageColor(img image.Image) (Color, Color) {
 	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
 		for x := bounds.Min.X; x < bounds.Max.X; x++ {
 			r, g, b, _ := img.At(x, y).RGBA()
-			totalR += int(r>>8)
-			totalG += int(g>>8)
-			totalB += int(b>>8)
+
+			// Average in OKLab so the mean doesn't turn muddy like an sRGB average
+			ok := Color{R: int(r>>8), G: int(g>>8), B: int(b>>8)}.ToOKLab()
+			total.L += ok.L
+			total.A += ok.A
+			total.B += ok.B
 			count++
 
 			colorCounts[Color{R: int(r>>8>>rbit<<rbit), G: int(g>>8>>rbit<<rbit), B: int(b>>8>>rbit<<rbit)}]++
 		}
 	}
 
-	avgR := totalR / count
-	avgG := totalG / count
-	avgB := totalB / count
+	// An empty image has nothing to average, and dividing by zero would give NaN channels
+	if count == 0 {
+		return Color{R: 0, G: 0, B: 0}, Color{R: 0, G: 0, B: 0}
+	}
 
-	avgColor := Color{R: avgR, G: avgG, B: avgB}
+	n := float64(count)
+	avgColor := OKLab{L: total.L / n, A: total.A / n, B: total.B / n}.ToColor()
 
 	commonColor := Color{R: 0, G: 0, B: 0}
 	commonColorCount := 0
@@ -0,0 +1,201 @@
+// Package layout positions album covers on a color wheel, mapping hue to angle
+// and saturation to distance from the center, then relaxing overlapping covers apart.
+package layout
+
+import (
+	"math"
+)
+
+const (
+	// DefaultIterations bounds the number of collision relaxation passes
+	DefaultIterations = 50
+	// DefaultMaxComparisons bounds the pair distance checks across all passes, so
+	// covers piled on one spot (like many grayscale ones in the center) can't run away
+	DefaultMaxComparisons = 10_000_000
+	// radiusDivisor matches the frontend, where the wheel radius is min(width, height) / 2.5
+	radiusDivisor = 2.5
+	// sizeDivisor gives the frontend's 100px covers on its 2400px canvas
+	sizeDivisor = 24
+)
+
+// Point is one item to place, described by its color
+type Point struct {
+	ID         string
+	Hue        float64 // degrees [0, 360)
+	Saturation float64 // [0, 1]
+}
+
+// Placement is the center and edge length of a placed cover, in canvas pixels
+type Placement struct {
+	ID   string  `json:"id"`
+	X    float64 `json:"x"`
+	Y    float64 `json:"y"`
+	Size float64 `json:"size"`
+}
+
+// Options controls the canvas and the relaxation
+type Options struct {
+	Width  float64
+	Height float64
+	// Size is the cover edge length, defaults to min(Width, Height) / 24
+	Size float64
+	// Iterations bounds relaxation passes, defaults to DefaultIterations
+	Iterations int
+	// MaxComparisons stops relaxation after this many pair checks, defaults to DefaultMaxComparisons
+	MaxComparisons int
+	// MaxDrift is how far relaxation may push a cover from where its color places it,
+	// defaults to twice Size. Together with the wheel edge this keeps loose covers
+	// from being thrown out away from the center.
+	MaxDrift float64
+}
+
+// Compute places every point on a Width x Height canvas
+func Compute(points []Point, opts Options) []Placement {
+	opts = withDefaults(opts)
+
+	centerX := opts.Width / 2
+	centerY := opts.Height / 2
+	maxRadius := math.Min(opts.Width, opts.Height) / radiusDivisor
+
+	// Start every cover where its color puts it on the wheel
+	placements := make([]Placement, len(points))
+	homes := make([]Placement, len(points))
+	for i, p := range points {
+		angle := p.Hue * math.Pi / 180
+		distance := clamp(p.Saturation, 0, 1) * maxRadius
+
+		placements[i] = Placement{
+			ID:   p.ID,
+			X:    centerX + distance*math.Cos(angle),
+			Y:    centerY + distance*math.Sin(angle),
+			Size: opts.Size,
+		}
+		homes[i] = placements[i]
+	}
+
+	// Covers may overlap until their centers are a diagonal apart
+	minDistance := math.Sqrt2 * opts.Size
+
+	// Only covers in neighbouring grid cells can overlap, so each pass buckets them into
+	// cells a minimum distance wide instead of checking every pair
+	comparisons := 0
+	for iter := 0; iter < opts.Iterations && comparisons < opts.MaxComparisons; iter++ {
+		moved := false
+
+		cells := make([]gridCell, len(placements))
+		grid := make(map[gridCell][]int)
+		for i, p := range placements {
+			cells[i] = cellOf(p, minDistance)
+			grid[cells[i]] = append(grid[cells[i]], i)
+		}
+
+	pairs:
+		for i := range placements {
+			for dx := -1; dx <= 1; dx++ {
+				for dy := -1; dy <= 1; dy++ {
+					for _, j := range grid[gridCell{X: cells[i].X + dx, Y: cells[i].Y + dy}] {
+						if j <= i {
+							continue
+						}
+						if comparisons >= opts.MaxComparisons {
+							break pairs
+						}
+						comparisons++
+						if separate(placements, i, j, minDistance) {
+							moved = true
+						}
+					}
+				}
+			}
+		}
+
+		for i := range placements {
+			constrain(&placements[i], homes[i], centerX, centerY, maxRadius, opts.MaxDrift)
+		}
+
+		if !moved {
+			break
+		}
+	}
+
+	return placements
+}
+
+// gridCell is a square of the neighbour grid, in units of the minimum distance
+type gridCell struct {
+	X int
+	Y int
+}
+
+func cellOf(p Placement, size float64) gridCell {
+	return gridCell{X: int(math.Floor(p.X / size)), Y: int(math.Floor(p.Y / size))}
+}
+
+// separate pushes covers i and j apart when they are closer than minDistance and
+// reports whether it moved them
+func separate(placements []Placement, i int, j int, minDistance float64) bool {
+	a, b := &placements[i], &placements[j]
+
+	dx := b.X - a.X
+	dy := b.Y - a.Y
+	distance := math.Hypot(dx, dy)
+	if distance >= minDistance {
+		return false
+	}
+
+	// Identical positions have no direction, so split them along a fixed axis per pair
+	dirX, dirY := 1.0, 0.0
+	if distance > 0 {
+		dirX, dirY = dx/distance, dy/distance
+	} else {
+		angle := float64(i*31+j*17) * math.Pi / 180
+		dirX, dirY = math.Cos(angle), math.Sin(angle)
+	}
+
+	// Move both covers apart by half the overlap each
+	push := (minDistance - distance) / 2
+	a.X -= dirX * push
+	a.Y -= dirY * push
+	b.X += dirX * push
+	b.Y += dirY * push
+	return true
+}
+
+// constrain pulls a cover back inside the wheel and within maxDrift of its home
+func constrain(p *Placement, home Placement, centerX, centerY, maxRadius, maxDrift float64) {
+	dx := p.X - home.X
+	dy := p.Y - home.Y
+	if drift := math.Hypot(dx, dy); drift > maxDrift {
+		p.X = home.X + dx/drift*maxDrift
+		p.Y = home.Y + dy/drift*maxDrift
+	}
+
+	// Covers can be nudged past the rim, but only by half their size
+	limit := maxRadius + p.Size/2
+	rx := p.X - centerX
+	ry := p.Y - centerY
+	if radius := math.Hypot(rx, ry); radius > limit {
+		p.X = centerX + rx/radius*limit
+		p.Y = centerY + ry/radius*limit
+	}
+}
+
+func withDefaults(opts Options) Options {
+	if opts.Size <= 0 {
+		opts.Size = math.Min(opts.Width, opts.Height) / sizeDivisor
+	}
+	if opts.Iterations <= 0 {
+		opts.Iterations = DefaultIterations
+	}
+	if opts.MaxComparisons <= 0 {
+		opts.MaxComparisons = DefaultMaxComparisons
+	}
+	if opts.MaxDrift <= 0 {
+		opts.MaxDrift = 2 * opts.Size
+	}
+	return opts
+}
+
+func clamp(v, lo, hi float64) float64 {
+	return math.Max(lo, math.Min(hi, v))
+}
@@ -0,0 +1,100 @@
+package layout
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+const epsilon = 1e-6
+
+func TestComputeSpreadsOverlappingCovers(t *testing.T) {
+	points := []Point{
+		{ID: "a", Hue: 90, Saturation: 0.5},
+		{ID: "b", Hue: 90, Saturation: 0.5},
+		{ID: "c", Hue: 91, Saturation: 0.5},
+	}
+	opts := Options{Width: 2400, Height: 2400}
+
+	placements := Compute(points, opts)
+
+	minDistance := math.Sqrt2 * withDefaults(opts).Size
+	for i := range placements {
+		for j := i + 1; j < len(placements); j++ {
+			distance := math.Hypot(placements[i].X-placements[j].X, placements[i].Y-placements[j].Y)
+			if distance < minDistance-epsilon {
+				t.Errorf("%s and %s are %.2f apart, want at least %.2f", placements[i].ID, placements[j].ID, distance, minDistance)
+			}
+		}
+	}
+}
+
+func TestComputeClampsDrift(t *testing.T) {
+	// Far more covers than fit around one spot, so relaxation pushes as hard as it can
+	points := make([]Point, 40)
+	for i := range points {
+		points[i] = Point{ID: fmt.Sprint(i), Hue: 200, Saturation: 0.3}
+	}
+	opts := Options{Width: 2400, Height: 2400}
+
+	placements := Compute(points, opts)
+
+	home := Compute(points[:1], opts)[0]
+	maxDrift := withDefaults(opts).MaxDrift
+	for _, p := range placements {
+		if drift := math.Hypot(p.X-home.X, p.Y-home.Y); drift > maxDrift+epsilon {
+			t.Errorf("cover %s drifted %.2f from its home, want at most %.2f", p.ID, drift, maxDrift)
+		}
+	}
+}
+
+func TestComputeKeepsCoversInsideRim(t *testing.T) {
+	// Fully saturated covers start on the rim and get pushed outward by their neighbours
+	points := make([]Point, 40)
+	for i := range points {
+		points[i] = Point{ID: fmt.Sprint(i), Hue: 10 + float64(i%3), Saturation: 1}
+	}
+	opts := Options{Width: 1200, Height: 800}
+
+	placements := Compute(points, opts)
+
+	maxRadius := math.Min(opts.Width, opts.Height) / radiusDivisor
+	for _, p := range placements {
+		radius := math.Hypot(p.X-opts.Width/2, p.Y-opts.Height/2)
+		if limit := maxRadius + p.Size/2; radius > limit+epsilon {
+			t.Errorf("cover %s is %.2f from the center, want at most %.2f", p.ID, radius, limit)
+		}
+	}
+}
+
+func TestComputeLargeInputsFinishQuickly(t *testing.T) {
+	tests := map[string]func(i int) Point{
+		// Spread around the wheel, as a big varied playlist would be
+		"spread": func(i int) Point {
+			return Point{ID: fmt.Sprint(i), Hue: float64(i*137%360) + float64(i%7)/7, Saturation: float64(i*61%100) / 100}
+		},
+		// Every cover on one spot, as with a pile of grayscale covers in the center
+		"piled": func(i int) Point {
+			return Point{ID: fmt.Sprint(i), Hue: 0, Saturation: 0}
+		},
+	}
+
+	for name, point := range tests {
+		t.Run(name, func(t *testing.T) {
+			points := make([]Point, 10000)
+			for i := range points {
+				points[i] = point(i)
+			}
+
+			start := time.Now()
+			placements := Compute(points, Options{Width: 2400, Height: 2400})
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Errorf("laying out %d covers took %v, want under 2s", len(points), elapsed)
+			}
+			if len(placements) != len(points) {
+				t.Errorf("got %d placements, want %d", len(placements), len(points))
+			}
+		})
+	}
+}
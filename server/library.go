@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"spotify-vis/spotify"
+)
+
+// NewAlbumTrackItem builds a TrackItem for collections of albums, which have no
+// particular track to show, so only the album fields are filled in
+func NewAlbumTrackItem(album spotify.Album) TrackItem {
+	return TrackItem{
+		Album: AlbumItem{
+			ID:     album.ID,
+			Name:   album.Name,
+			URL:    album.Href,
+			Images: album.Images,
+		},
+	}
+}
+
+// GetSavedAlbumItems processes every album in the current user's library
+func GetSavedAlbumItems(ctx context.Context, accessToken string) ([]ProcessedItem, error) {
+	firstPage, err := spotifyClient.SavedAlbums(ctx, accessToken, 0, 50)
+	if err != nil {
+		return nil, err
+	}
+	fetchPage := func(ctx context.Context, offset int, limit int) (*spotify.Paging[spotify.SavedAlbum], error) {
+		return spotifyClient.SavedAlbums(ctx, accessToken, offset, limit)
+	}
+	saved, err := spotify.AllPagesConcurrent(ctx, firstPage, fetchPage, pageConcurrency)
+	if err != nil {
+		return nil, err
+	}
+
+	trackItems := make([]TrackItem, len(saved))
+	for i, entry := range saved {
+		trackItems[i] = NewAlbumTrackItem(entry.Album)
+	}
+
+	return processTrackItems(ctx, trackItems)
+}
+
+// GetSavedTrackItems processes one item per album across the current user's saved tracks
+func GetSavedTrackItems(ctx context.Context, accessToken string) ([]ProcessedItem, error) {
+	firstPage, err := spotifyClient.SavedTracks(ctx, accessToken, 0, 50)
+	if err != nil {
+		return nil, err
+	}
+	fetchPage := func(ctx context.Context, offset int, limit int) (*spotify.Paging[spotify.SavedTrack], error) {
+		return spotifyClient.SavedTracks(ctx, accessToken, offset, limit)
+	}
+	saved, err := spotify.AllPagesConcurrent(ctx, firstPage, fetchPage, pageConcurrency)
+	if err != nil {
+		return nil, err
+	}
+
+	tracks := make([]spotify.Track, len(saved))
+	for i, entry := range saved {
+		tracks[i] = entry.Track
+	}
+
+	return processTrackItems(ctx, UniqueAlbumTracks(tracks))
+}
+
+// GetArtistAlbumItems processes every album and single in an artist's discography
+func GetArtistAlbumItems(ctx context.Context, accessToken string, artistID string) ([]ProcessedItem, error) {
+	firstPage, err := spotifyClient.ArtistAlbums(ctx, accessToken, artistID, 0, 50)
+	if err != nil {
+		return nil, err
+	}
+	fetchPage := func(ctx context.Context, offset int, limit int) (*spotify.Paging[spotify.Album], error) {
+		return spotifyClient.ArtistAlbums(ctx, accessToken, artistID, offset, limit)
+	}
+	albums, err := spotify.AllPagesConcurrent(ctx, firstPage, fetchPage, pageConcurrency)
+	if err != nil {
+		return nil, err
+	}
+
+	// Albums can show up more than once, e.g. in several markets
+	trackItems := []TrackItem{}
+	albumSet := make(map[string]bool)
+	for _, album := range albums {
+		if !albumSet[album.ID] {
+			trackItems = append(trackItems, NewAlbumTrackItem(album))
+			albumSet[album.ID] = true
+		}
+	}
+
+	return processTrackItems(ctx, trackItems)
+}
+
+// GetAlbumTrackItems returns one item per track of an album. They all share the
+// album's colors, which only need to be processed once.
+func GetAlbumTrackItems(ctx context.Context, accessToken string, albumID string) ([]ProcessedItem, error) {
+	album, err := spotifyClient.Album(ctx, accessToken, albumID)
+	if err != nil {
+		return nil, err
+	}
+
+	firstPage, err := spotifyClient.AlbumTracks(ctx, accessToken, albumID, 0, 50)
+	if err != nil {
+		return nil, err
+	}
+	fetchPage := func(ctx context.Context, offset int, limit int) (*spotify.Paging[spotify.SimpleTrack], error) {
+		return spotifyClient.AlbumTracks(ctx, accessToken, albumID, offset, limit)
+	}
+	tracks, err := spotify.AllPagesConcurrent(ctx, firstPage, fetchPage, pageConcurrency)
+	if err != nil {
+		return nil, err
+	}
+
+	albumItems, err := processTrackItems(ctx, []TrackItem{NewAlbumTrackItem(*album)})
+	if err != nil {
+		return nil, err
+	}
+	albumItem := albumItems[0]
+
+	processedItems := make([]ProcessedItem, len(tracks))
+	for i, track := range tracks {
+		item := albumItem
+		item.Track.ID = track.ID
+		item.Track.Name = track.Name
+		processedItems[i] = item
+	}
+
+	return processedItems, nil
+}
+
+// processTrackItems runs the image pipeline and reports cancellation as an error
+func processTrackItems(ctx context.Context, trackItems []TrackItem) ([]ProcessedItem, error) {
+	start := time.Now()
+	processedItems := HandoffItemsForImageProcessing(ctx, trackItems)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	loggerFrom(ctx).Debug("Processed albums", "count", len(processedItems), "elapsed", time.Since(start))
+
+	return processedItems, nil
+}
+
+// Endpoint handler for /library/albums
+func savedAlbums(w http.ResponseWriter, r *http.Request) {
+	serveProcessedItems(w, r, "/library/albums", true, GetSavedAlbumItems)
+}
+
+// Endpoint handler for /library/tracks
+func savedTracks(w http.ResponseWriter, r *http.Request) {
+	serveProcessedItems(w, r, "/library/tracks", true, GetSavedTrackItems)
+}
+
+// Endpoint handler for /artist/{artistId}
+func artistAlbums(w http.ResponseWriter, r *http.Request) {
+	artistID := pathID(r, "/artist/")
+	serveProcessedItems(w, r, "/artist/{artistId}", false, func(ctx context.Context, accessToken string) ([]ProcessedItem, error) {
+		return GetArtistAlbumItems(ctx, accessToken, artistID)
+	})
+}
+
+// Endpoint handler for /album/{albumId}
+func albumTracks(w http.ResponseWriter, r *http.Request) {
+	albumID := pathID(r, "/album/")
+	serveProcessedItems(w, r, "/album/{albumId}", false, func(ctx context.Context, accessToken string) ([]ProcessedItem, error) {
+		return GetAlbumTrackItems(ctx, accessToken, albumID)
+	})
+}
+
+// pathID returns the path segment right after prefix
+func pathID(r *http.Request, prefix string) string {
+	return strings.Split(strings.TrimPrefix(r.URL.Path, prefix), "/")[0]
+}
+
+// serveProcessedItems handles the shared parts of the item endpoints: CORS, picking
+// the access token (the session's, or the app token when requireLogin is false and
+// there is no session), and writing load's items as JSON
+func serveProcessedItems(w http.ResponseWriter, r *http.Request, name string, requireLogin bool, load func(ctx context.Context, accessToken string) ([]ProcessedItem, error)) {
+	loggerFrom(r.Context()).Debug("Running handler", "handler", name)
+
+	// Add CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", os.Getenv("FRONTEND_URL"))
+	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+
+	// Handle preflight OPTIONS request
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var accessToken string
+	if requireLogin {
+		session, ok := requireSession(w, r)
+		if !ok {
+			return
+		}
+		accessToken = session.Token.AccessToken
+	} else {
+		token, ok := sessionOrAppToken(w, r)
+		if !ok {
+			return
+		}
+		accessToken = token
+	}
+
+	items, err := load(r.Context(), accessToken)
+	if err != nil {
+		loggerFrom(r.Context()).Error("Error loading items", "handler", name, "err", err)
+		w.Header().Set("Content-Type", "application/json")
+		if status := spotifyStatus(err); status == http.StatusNotFound || status == http.StatusBadRequest {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error": "Not found"}`))
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error": "Failed to fetch tracks"}`))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(items)
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// redacted replaces the value of anything secret that makes it into a log line
+const redacted = "[REDACTED]"
+
+// sensitiveKeys are attribute keys and query params whose values are never logged
+var sensitiveKeys = map[string]bool{
+	"authorization": true,
+	"cookie":        true,
+	"token":         true,
+	"access_token":  true,
+	"refresh_token": true,
+	"client_secret": true,
+	"session":       true,
+	"session_id":    true,
+	"code":          true,
+	"code_verifier": true,
+	"state":         true,
+}
+
+// requestIDHeader carries the request ID back to the client, or in from a proxy that set one
+const requestIDHeader = "X-Request-ID"
+
+type loggerKey struct{}
+
+// initLogging installs the default slog logger, configured by LOG_FORMAT ("text" or
+// "json") and LOG_LEVEL ("debug", "info", "warn" or "error")
+func initLogging() error {
+	var level slog.Level
+	if raw := os.Getenv("LOG_LEVEL"); raw != "" {
+		if err := level.UnmarshalText([]byte(raw)); err != nil {
+			return fmt.Errorf("invalid LOG_LEVEL: %q", raw)
+		}
+	}
+
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: redactAttr}
+
+	var handler slog.Handler
+	switch format := os.Getenv("LOG_FORMAT"); format {
+	case "", "text":
+		handler = slog.NewTextHandler(os.Stdout, opts)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stdout, opts)
+	default:
+		return fmt.Errorf("invalid LOG_FORMAT: %q", format)
+	}
+
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// redactAttr hides the values of sensitive attributes, including everything inside a
+// sensitive group, and of sensitive query params and credentials inside string values.
+// Values of any other type are redacted field by field through their JSON form.
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	for _, group := range groups {
+		if sensitiveKeys[strings.ToLower(group)] {
+			return slog.String(a.Key, redacted)
+		}
+	}
+	if sensitiveKeys[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, redacted)
+	}
+
+	value := a.Value.Resolve()
+	switch value.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, redactString(value.String()))
+	case slog.KindGroup:
+		attrs := value.Group()
+		redactedAttrs := make([]any, len(attrs))
+		for i, attr := range attrs {
+			redactedAttrs[i] = redactAttr(nil, attr)
+		}
+		return slog.Group(a.Key, redactedAttrs...)
+	case slog.KindAny:
+		return slog.Any(a.Key, redactAny(value.Any()))
+	}
+	return slog.Attr{Key: a.Key, Value: value}
+}
+
+// redactAny makes a redacted copy of an arbitrary logged value. Errors are logged as
+// their message, anything else is walked through its JSON encoding.
+func redactAny(v any) any {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case error:
+		return redactString(v.Error())
+	case fmt.Stringer:
+		return redactString(v.String())
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return redactString(fmt.Sprint(v))
+	}
+	var decoded any
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return redactString(fmt.Sprint(v))
+	}
+	return redactJSON(decoded)
+}
+
+// redactJSON redacts sensitive keys and strings in a decoded JSON value
+func redactJSON(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for key, value := range v {
+			if sensitiveKeys[strings.ToLower(key)] {
+				v[key] = redacted
+			} else {
+				v[key] = redactJSON(value)
+			}
+		}
+		return v
+	case []any:
+		for i, value := range v {
+			v[i] = redactJSON(value)
+		}
+		return v
+	case string:
+		return redactString(v)
+	}
+	return v
+}
+
+// credentialPattern matches Authorization header credentials anywhere in a string
+var credentialPattern = regexp.MustCompile(`\b(Bearer|Basic) [^\s"']+`)
+
+// urlPattern matches URLs anywhere in a string, such as inside an error message
+var urlPattern = regexp.MustCompile(`https?://[^\s"']+`)
+
+// redactString hides Authorization header credentials and sensitive URL query params
+func redactString(s string) string {
+	s = credentialPattern.ReplaceAllString(s, "$1 "+redacted)
+	if !strings.Contains(s, "?") {
+		return s
+	}
+	return urlPattern.ReplaceAllStringFunc(s, redactURL)
+}
+
+// redactURL hides the values of sensitive query params in a URL
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.RawQuery == "" {
+		return s
+	}
+	query := u.Query()
+	for key := range query {
+		if sensitiveKeys[strings.ToLower(key)] {
+			query.Set(key, redacted)
+		}
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// fatal logs err and exits, for failures the server can't start without
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
+}
+
+// loggerFrom returns the request's logger, which tags every line with its request
+// ID, or the default logger outside of a request
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// statusRecorder remembers the status code written through it
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// Flush passes through to the underlying writer so event streams keep working
+func (s *statusRecorder) Flush() {
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// validRequestID reports whether id is 1 to 64 characters of [A-Za-z0-9._-]
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '.', c == '_', c == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// withRequestID gives every request an ID, exposes it in the X-Request-ID header,
+// attaches a logger carrying it to the request context and logs each request once
+// it has been served
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		// A proxy's ID is kept so lines can be matched up, but only when it can't
+		// smuggle anything odd into the logs or the response
+		requestID := r.Header.Get(requestIDHeader)
+		if !validRequestID(requestID) {
+			id, err := randomToken(12)
+			if err != nil {
+				id = fmt.Sprintf("%d", start.UnixNano())
+			}
+			requestID = id
+		}
+		w.Header().Set(requestIDHeader, requestID)
+
+		logger := slog.Default().With("request_id", requestID)
+		r = r.WithContext(context.WithValue(r.Context(), loggerKey{}, logger))
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		logger.Info("Handled request",
+			"method", r.Method,
+			"url", r.URL.String(),
+			"status", recorder.status,
+			"duration", time.Since(start))
+	})
+}
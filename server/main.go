@@ -3,18 +3,21 @@ package main
 import (
 	"bytes"
 	"context"
-	"encoding/base64"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"log"
+	"log/slog"
+	"math"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/redis/go-redis/v9"
+	"spotify-vis/spotify"
+
 	"github.com/joho/godotenv"
 	"go.etcd.io/bbolt"
 )
@@ -30,99 +33,100 @@ type SpotifyTokenResponse struct {
 
 // Endpoint handler for /login
 func login(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("Running func: /login")
+	loggerFrom(r.Context()).Debug("Running handler", "handler", "/login")
 	baseUrl := "https://accounts.spotify.com/authorize"
 
 	params := url.Values{}
 	params.Add("client_id", os.Getenv("SPOTIFY_CLIENT_ID"))
 	params.Add("response_type", "code")
 	params.Add("redirect_uri", os.Getenv("REDIRECT_URI"))
-	params.Add("scope", "user-read-private user-read-email user-read-playback-state user-modify-playback-state playlist-read-collaborative playlist-read-private")
-	params.Add("state", "1234567890")
+	params.Add("scope", "user-read-private user-read-email user-read-playback-state user-modify-playback-state playlist-read-collaborative playlist-read-private user-library-read user-top-read user-read-recently-played playlist-modify-public playlist-modify-private")
 	params.Add("show_dialog", "true")
 
+	// A fresh state per attempt, remembered in this browser, lets callback reject
+	// codes from logins this browser never started
+	oauthState, err := NewOAuthState(db, usePKCE())
+	if err != nil {
+		loggerFrom(r.Context()).Error("Error creating login state", "err", err)
+		http.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+	params.Add("state", oauthState.State)
+	if oauthState.CodeVerifier != "" {
+		params.Add("code_challenge_method", "S256")
+		params.Add("code_challenge", pkceChallenge(oauthState.CodeVerifier))
+	}
+	setOAuthStateCookie(w, oauthState.State)
+
 	finalUrl := fmt.Sprintf("%s?%s", baseUrl, params.Encode())
-	fmt.Println(fmt.Sprintf("Routing to this url: %s", finalUrl))
+	loggerFrom(r.Context()).Debug("Redirecting to Spotify login", "url", finalUrl)
 
 	http.Redirect(w, r, finalUrl, http.StatusFound)
 }
 
 // Endpoint handler for /callback
 func callback(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("Running func: /callback")
-	fmt.Println(fmt.Sprintf("Request: %s", r.URL))
-
-	// Pull the access code that came back from spotify user login
-	code := r.URL.Query().Get("code")
-	fmt.Println(fmt.Sprintf("Code: %s", code))
+	loggerFrom(r.Context()).Debug("Running handler", "handler", "/callback")
 
-	// Make a call to convert to a token
-	params := url.Values{}
-	params.Add("grant_type", "authorization_code")
-	params.Add("code", code)
-	params.Add("redirect_uri", os.Getenv("REDIRECT_URI"))
-
-	tokenUrl := "https://accounts.spotify.com/api/token"
+	// Whatever happens, this login attempt is over
+	stateCookie, cookieErr := r.Cookie(oauthStateCookie)
+	clearOAuthStateCookie(w)
 
-	req, err := http.NewRequest("POST", tokenUrl, strings.NewReader(params.Encode()))
-	if err != nil {
-		log.Fatal(err)
+	// The state has to match the one this browser was sent off to Spotify with
+	state := r.URL.Query().Get("state")
+	if state == "" || cookieErr != nil || subtle.ConstantTimeCompare([]byte(state), []byte(stateCookie.Value)) != 1 {
+		loggerFrom(r.Context()).Warn("Rejecting callback with a state that doesn't match the login cookie")
+		http.Error(w, "Invalid login state, please try logging in again", http.StatusBadRequest)
+		return
 	}
-
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-	authString := fmt.Sprintf("%s:%s", os.Getenv("SPOTIFY_CLIENT_ID"), os.Getenv("SPOTIFY_CLIENT_SECRET"))
-	encodedAuth := base64.StdEncoding.EncodeToString([]byte(authString))
-	req.Header.Add("Authorization", fmt.Sprintf("Basic %s", encodedAuth))
-
-	// Make the request
-	fmt.Println("Making request to Spotify token endpoint...")
-	fmt.Println(fmt.Sprintf("Request: %s", req.URL))
-	fmt.Println(fmt.Sprintf("Request body: %s", params.Encode()))
-	fmt.Println(fmt.Sprintf("Authorization: %s", encodedAuth))
-	resp, err := http.DefaultClient.Do(req)
+	oauthState, err := ConsumeOAuthState(db, state)
 	if err != nil {
-		log.Fatal("Error making request to Spotify token endpoint: ", err)
+		loggerFrom(r.Context()).Warn("Rejecting callback", "err", err)
+		http.Error(w, "Invalid login state, please try logging in again", http.StatusBadRequest)
+		return
 	}
 
-	// Handle the response
-	fmt.Println(fmt.Sprintf("Response: %s", resp.Status))
-	fmt.Println(fmt.Sprintf("Response body: %s", resp.Body))
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Fatal("Error reading response body: ", err)
+	// The user can turn down the login on Spotify's side
+	if authErr := r.URL.Query().Get("error"); authErr != "" {
+		loggerFrom(r.Context()).Warn("Spotify login failed", "reason", authErr)
+		http.Error(w, "Spotify login was not completed", http.StatusBadRequest)
+		return
 	}
-	fmt.Println("Response body content:", string(body))
-	// Reset the response body for later use
-	resp.Body = io.NopCloser(bytes.NewBuffer(body))
 
-	defer resp.Body.Close()
+	// Pull the access code that came back from spotify user login
+	code := r.URL.Query().Get("code")
 
-	// Parse the response
-	var tokenResponse SpotifyTokenResponse
-	if err := json.NewDecoder(resp.Body).Decode(&tokenResponse); err != nil {
-		log.Printf("Error decoding response: %v", err)
-		http.Error(w, "Failed to decode response", http.StatusInternalServerError)
+	// Make a call to convert to a token
+	loggerFrom(r.Context()).Debug("Making request to Spotify token endpoint")
+	tokenResponse, err := ExchangeAuthorizationCode(code, oauthState.CodeVerifier)
+	if err != nil {
+		loggerFrom(r.Context()).Error("Error exchanging authorization code", "err", err)
+		http.Error(w, "Failed to get access token", http.StatusBadGateway)
 		return
 	}
 
-	// Now you can access the parsed response
-	fmt.Printf("Access Token: %s\n", tokenResponse.AccessToken)
-	fmt.Printf("Token Type: %s\n", tokenResponse.TokenType)
-	fmt.Printf("Expires In: %d seconds\n", tokenResponse.ExpiresIn)
-	fmt.Printf("Scope: %s\n", tokenResponse.Scope)
+	// Never log the tokens themselves
+	loggerFrom(r.Context()).Info("Received user token",
+		"token_type", tokenResponse.TokenType,
+		"expires_in", tokenResponse.ExpiresIn,
+		"scope", tokenResponse.Scope)
 
 	// Store the token in bbolt and get a session ID
 	if tokenResponse.AccessToken != "" {
 		sessionID, err := StoreSession(db, tokenResponse)
 		if err != nil {
-			log.Printf("Error storing session: %v", err)
+			loggerFrom(r.Context()).Error("Error storing session", "err", err)
 			http.Error(w, "Failed to create session", http.StatusInternalServerError)
 			return
 		}
 
-		// Redirect to the frontend with the session ID instead of the token
-		route := fmt.Sprintf("%s?session_id=%s", os.Getenv("FRONTEND_URL"), sessionID)
-		fmt.Println(fmt.Sprintf("Redirecting to: %s", route))
+		// The session ID travels in a signed cookie, and only in the URL for older clients
+		setSessionCookie(w, sessionID)
+		route := os.Getenv("FRONTEND_URL")
+		if allowSessionQueryParam() {
+			route = fmt.Sprintf("%s?session_id=%s", route, url.QueryEscape(sessionID))
+		}
+		loggerFrom(r.Context()).Debug("Redirecting to frontend", "url", route)
 		http.Redirect(w, r, route, http.StatusFound)
 		return
 	}
@@ -133,7 +137,7 @@ func callback(w http.ResponseWriter, r *http.Request) {
 // Endpoint handler for /data
 func data(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
-	fmt.Println("\n\nRunning func: /data")
+	loggerFrom(r.Context()).Debug("Running handler", "handler", "/data")
 
 	// Add CORS headers
 	w.Header().Set("Access-Control-Allow-Origin", os.Getenv("FRONTEND_URL"))
@@ -147,32 +151,33 @@ func data(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sessionID := r.URL.Query().Get("session_id")
+	sessionID := sessionIDFromRequest(r)
 	if sessionID == "" {
 		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(`{"error": "No session ID provided"}`))
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"error": "Not logged in"}`))
 		return
 	}
 
 	// Get the session from bbolt
 	session, err := GetSession(db, sessionID)
 	if err != nil {
-		log.Printf("Error retrieving session: %v", err)
+		loggerFrom(r.Context()).Warn("Error retrieving session", "err", err)
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusUnauthorized)
 		w.Write([]byte(`{"error": "Invalid or expired session"}`))
 		return
 	}
+	renewSessionCookie(w, session)
 
 	accessToken := session.Token.AccessToken
-	fmt.Println(fmt.Sprintf("Retrieved access token for session: %s", sessionID))
+	loggerFrom(r.Context()).Debug("Retrieved access token for session", "session_id", sessionID)
 
 	// Directly get the current user's playlists without needing the user profile
-	fmt.Println("Fetching current user's playlists")
-	body, err := GetCurrentUserPlaylists(accessToken)
+	loggerFrom(r.Context()).Debug("Fetching current user's playlists")
+	body, err := GetCurrentUserPlaylists(r.Context(), accessToken)
 	if err != nil {
-		log.Printf("Error getting user playlists: %v", err)
+		loggerFrom(r.Context()).Error("Error getting user playlists", "err", err)
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(`{"error": "Failed to fetch user playlists"}`))
@@ -185,8 +190,7 @@ func data(w http.ResponseWriter, r *http.Request) {
 	// Write the JSON response directly to the ResponseWriter
 	w.Write(body)
 
-	elapsed := time.Since(start)
-	fmt.Printf("Data function took %s\n", elapsed)
+	loggerFrom(r.Context()).Debug("Data function finished", "elapsed", time.Since(start))
 }
 
 func user(w http.ResponseWriter, r *http.Request) {
@@ -202,25 +206,26 @@ func user(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	fmt.Println("Running func: /user")
-	sessionID := r.URL.Query().Get("session_id")
+	loggerFrom(r.Context()).Debug("Running handler", "handler", "/user")
+	sessionID := sessionIDFromRequest(r)
 	if sessionID == "" {
-		http.Error(w, "No session ID provided", http.StatusBadRequest)
+		http.Error(w, "Not logged in", http.StatusUnauthorized)
 		return
 	}
 
 	// Get the session from bbolt
 	session, err := GetSession(db, sessionID)
 	if err != nil {
-		log.Printf("Error retrieving session: %v", err)
+		loggerFrom(r.Context()).Warn("Error retrieving session", "err", err)
 		http.Error(w, "Invalid or expired session", http.StatusUnauthorized)
 		return
 	}
+	renewSessionCookie(w, session)
 
 	accessToken := session.Token.AccessToken
-	userProfileBody, err := GetUserProfile(accessToken)
+	userProfileBody, err := GetUserProfile(r.Context(), accessToken)
 	if err != nil {
-		log.Printf("Error getting user profile: %v", err)
+		loggerFrom(r.Context()).Error("Error getting user profile", "err", err)
 		http.Error(w, "Failed to fetch user data", http.StatusInternalServerError)
 		return
 	}
@@ -249,17 +254,20 @@ func logout(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	fmt.Println("Running func: /logout")
-	sessionID := r.URL.Query().Get("session_id")
+	loggerFrom(r.Context()).Debug("Running handler", "handler", "/logout")
+	sessionID := sessionIDFromRequest(r)
 	if sessionID == "" {
-		http.Error(w, "No session ID provided", http.StatusBadRequest)
+		http.Error(w, "Not logged in", http.StatusUnauthorized)
 		return
 	}
 
+	// The cookie goes either way, so a stale one can't keep the browser half logged in
+	clearSessionCookie(w)
+
 	// Delete the session
 	err := DeleteSession(db, sessionID)
 	if err != nil {
-		log.Printf("Error deleting session: %v", err)
+		loggerFrom(r.Context()).Error("Error deleting session", "err", err)
 		http.Error(w, "Failed to logout", http.StatusInternalServerError)
 		return
 	}
@@ -270,11 +278,11 @@ func logout(w http.ResponseWriter, r *http.Request) {
 
 // Endpoint handler for /playlist/{playlistId}
 func playlistTracks(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("\n\nRunning func: /playlist/{playlistId}")
+	loggerFrom(r.Context()).Debug("Running handler", "handler", "/playlist/{playlistId}")
 
 	// Add CORS headers
 	w.Header().Set("Access-Control-Allow-Origin", os.Getenv("FRONTEND_URL"))
-	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
 	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
 	w.Header().Set("Access-Control-Allow-Credentials", "true")
 
@@ -298,92 +306,420 @@ func playlistTracks(w http.ResponseWriter, r *http.Request) {
 	}
 
 	playlistID := pathParts[2]
-	sessionID := r.URL.Query().Get("session_id")
 
-	if sessionID == "" {
+	if playlistID == "" {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(`{"error": "No session ID provided"}`))
+		w.Write([]byte(`{"error": "No playlist ID provided in URL path"}`))
 		return
 	}
 
-	if playlistID == "" {
+	// URL format: /playlist/{playlistId}/sorted, which writes to the user's account
+	if len(pathParts) > 3 && pathParts[3] == "sorted" {
+		playlistSorted(w, r, playlistID)
+		return
+	}
+
+	// Logged out visitors can still view public playlists with the app token
+	accessToken, ok := sessionOrAppToken(w, r)
+	if !ok {
+		return
+	}
+
+	// URL format: /playlist/{playlistId}/layout
+	if len(pathParts) > 3 && pathParts[3] == "layout" {
+		playlistLayout(w, r, playlistID, accessToken)
+		return
+	}
+
+	// URL format: /playlist/{playlistId}/stream
+	if len(pathParts) > 3 && pathParts[3] == "stream" {
+		playlistTracksStream(w, r, playlistID, accessToken)
+		return
+	}
+
+	// URL format: /playlist/{playlistId}/poster
+	if len(pathParts) > 3 && pathParts[3] == "poster" {
+		playlistPoster(w, r, playlistID, accessToken)
+		return
+	}
+
+	// Get the playlist tracks
+	loggerFrom(r.Context()).Debug("Fetching tracks for playlist", "playlist_id", playlistID)
+	body, err := GetPlaylistTracks(r.Context(), playlistID, accessToken)
+	if err != nil {
+		writePlaylistError(w, r, err)
+		return
+	}
+
+	// Set content type header to application/json
+	w.Header().Set("Content-Type", "application/json")
+
+	// Write the JSON response directly to the ResponseWriter
+	w.Write(body)
+}
+
+// Endpoint handler for /resolve?q={url, uri or id}, looks up a playlist's metadata.
+// Uses the viewer's session when there is one and an app token otherwise, so any
+// public playlist can be resolved without logging in.
+func resolvePlaylist(w http.ResponseWriter, r *http.Request) {
+	loggerFrom(r.Context()).Debug("Running handler", "handler", "/resolve")
+
+	// Add CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", os.Getenv("FRONTEND_URL"))
+	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+
+	// Handle preflight OPTIONS request
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	playlistID, err := spotify.ParsePlaylistID(r.URL.Query().Get("q"))
+	if err != nil {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(`{"error": "No playlist ID provided in URL path"}`))
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	accessToken, ok := sessionOrAppToken(w, r)
+	if !ok {
 		return
 	}
 
+	playlist, err := spotifyClient.Playlist(r.Context(), accessToken, playlistID)
+	if err != nil {
+		writePlaylistError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(playlist)
+}
+
+// sessionOrAppToken picks the access token for a request that can read public data:
+// the session's token when the request has a session, otherwise the shared app token.
+// Writes an error response and returns false when neither is available.
+func sessionOrAppToken(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if sessionID := sessionIDFromRequest(r); sessionID != "" {
+		session, err := GetSession(db, sessionID)
+		if err != nil {
+			loggerFrom(r.Context()).Warn("Error retrieving session", "err", err)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error": "Invalid or expired session"}`))
+			return "", false
+		}
+		renewSessionCookie(w, session)
+		loggerFrom(r.Context()).Debug("Retrieved access token for session", "session_id", sessionID)
+		return session.Token.AccessToken, true
+	}
+
+	if !appTokensEnabled {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"error": "Login required"}`))
+		return "", false
+	}
+
+	accessToken, err := appTokens.Token()
+	if err != nil {
+		loggerFrom(r.Context()).Error("Error getting app token", "err", err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error": "Failed to authenticate with Spotify"}`))
+		return "", false
+	}
+	return accessToken, true
+}
+
+// requireSession loads the request's session (see sessionIDFromRequest), writing an error
+// response and returning false when it is missing or invalid
+func requireSession(w http.ResponseWriter, r *http.Request) (*Session, bool) {
+	sessionID := sessionIDFromRequest(r)
+	if sessionID == "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"error": "Not logged in"}`))
+		return nil, false
+	}
+
 	// Get the session from bbolt
 	session, err := GetSession(db, sessionID)
 	if err != nil {
-		log.Printf("Error retrieving session: %v", err)
+		loggerFrom(r.Context()).Warn("Error retrieving session", "err", err)
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusUnauthorized)
 		w.Write([]byte(`{"error": "Invalid or expired session"}`))
+		return nil, false
+	}
+	renewSessionCookie(w, session)
+
+	return session, true
+}
+
+// spotifyStatus returns the status code of a Spotify API error, or 0 for any other error
+func spotifyStatus(err error) int {
+	var apiErr *spotify.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode
+	}
+	return 0
+}
+
+// writePlaylistError reports a failed playlist lookup, telling missing (or private,
+// which Spotify also answers with 404) playlists apart from other failures
+func writePlaylistError(w http.ResponseWriter, r *http.Request, err error) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if status := spotifyStatus(err); status == http.StatusNotFound || status == http.StatusBadRequest {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error": "Playlist not found or not public"}`))
 		return
 	}
 
-	accessToken := session.Token.AccessToken
-	fmt.Println(fmt.Sprintf("Retrieved access token for session: %s", sessionID))
+	loggerFrom(r.Context()).Error("Error getting playlist", "err", err)
+	w.WriteHeader(http.StatusInternalServerError)
+	w.Write([]byte(`{"error": "Failed to fetch playlist tracks"}`))
+}
 
-	// Get the playlist tracks
-	fmt.Println(fmt.Sprintf("Fetching tracks for playlist: %s", playlistID))
-	body, err := GetPlaylistTracks(playlistID, accessToken)
-	if err != nil {
-		log.Printf("Error getting playlist tracks: %v", err)
+// DefaultCanvasSize matches the frontend's color wheel canvas
+const DefaultCanvasSize = 2400
+
+// LayoutItem is a placed album cover in the /playlist/{playlistId}/layout response
+type LayoutItem struct {
+	AlbumID  string  `json:"albumId"`
+	TrackID  string  `json:"trackId"`
+	ImageURL string  `json:"imageUrl"`
+	X        float64 `json:"x"`
+	Y        float64 `json:"y"`
+	Size     float64 `json:"size"`
+}
+
+// Handler for /playlist/{playlistId}/layout, lays the albums out on a color wheel
+// for a canvas given by the width and height query params
+func playlistLayout(w http.ResponseWriter, r *http.Request, playlistID string, accessToken string) {
+	loggerFrom(r.Context()).Debug("Running handler", "handler", "/playlist/{playlistId}/layout")
+
+	width, errW := floatParam(r, "width", DefaultCanvasSize)
+	height, errH := floatParam(r, "height", DefaultCanvasSize)
+	if errW != nil || errH != nil || width <= 0 || height <= 0 {
 		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte(`{"error": "Failed to fetch playlist tracks"}`))
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": "width and height must be positive numbers"}`))
 		return
 	}
 
-	// Set content type header to application/json
-	w.Header().Set("Content-Type", "application/json")
+	colorMode := r.URL.Query().Get("color")
+	if colorMode != "" && colorMode != "avg" && colorMode != "common" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": "color must be avg or common"}`))
+		return
+	}
 
-	// Write the JSON response directly to the ResponseWriter
+	items, err := GetPlaylistItems(r.Context(), playlistID, accessToken)
+	if err != nil {
+		writePlaylistError(w, r, err)
+		return
+	}
+
+	// Covers that couldn't be loaded have no colors to place them by
+	items = AvailableItems(items)
+	placements := LayoutItems(items, width, height, colorMode)
+
+	layoutItems := make([]LayoutItem, len(items))
+	for i, item := range items {
+		imageURL := ""
+		if len(item.Track.Album.Images) > 0 {
+			imageURL = item.Track.Album.Images[0].URL
+		}
+		layoutItems[i] = LayoutItem{
+			AlbumID:  item.Track.Album.ID,
+			TrackID:  item.Track.ID,
+			ImageURL: imageURL,
+			X:        placements[i].X,
+			Y:        placements[i].Y,
+			Size:     placements[i].Size,
+		}
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"width":  width,
+		"height": height,
+		"items":  layoutItems,
+	})
+	if err != nil {
+		loggerFrom(r.Context()).Error("Error marshaling layout", "err", err)
+		http.Error(w, "Failed to build layout", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
 	w.Write(body)
 }
 
+// Handler for /playlist/{playlistId}/poster, renders the color wheel to an image.
+// Query params: format (png|svg), width, height, background (hex) and color (avg|common)
+func playlistPoster(w http.ResponseWriter, r *http.Request, playlistID string, accessToken string) {
+	loggerFrom(r.Context()).Debug("Running handler", "handler", "/playlist/{playlistId}/poster")
+
+	opts := DefaultPosterOptions()
+	query := r.URL.Query()
+	if format := query.Get("format"); format != "" {
+		opts.Format = format
+	}
+	if background := query.Get("background"); background != "" {
+		opts.Background = background
+	}
+	if colorMode := query.Get("color"); colorMode != "" {
+		opts.ColorMode = colorMode
+	}
+	width, errW := floatParam(r, "width", float64(opts.Width))
+	height, errH := floatParam(r, "height", float64(opts.Height))
+	opts.Width, opts.Height = int(width), int(height)
+
+	if err := opts.Validate(); err != nil || errW != nil || errH != nil {
+		message := "width and height must be numbers"
+		if err != nil {
+			message = err.Error()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": message})
+		return
+	}
+
+	items, err := GetPlaylistItems(r.Context(), playlistID, accessToken)
+	if err != nil {
+		writePlaylistError(w, r, err)
+		return
+	}
+
+	// Render into a buffer first so a failure can still return a proper error
+	var buf bytes.Buffer
+	if err := RenderPoster(r.Context(), &buf, items, opts); err != nil {
+		loggerFrom(r.Context()).Error("Error rendering poster", "err", err)
+		http.Error(w, "Failed to render poster", http.StatusInternalServerError)
+		return
+	}
+
+	if opts.Format == "svg" {
+		w.Header().Set("Content-Type", "image/svg+xml")
+	} else {
+		w.Header().Set("Content-Type", "image/png")
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`inline; filename="%s.%s"`, playlistID, opts.Format))
+	w.Write(buf.Bytes())
+}
+
+// floatParam parses a finite float query param, falling back to def when it is missing
+func floatParam(r *http.Request, name string, def float64) (float64, error) {
+	raw := r.URL.Query().Get(name)
+	if raw == "" {
+		return def, nil
+	}
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return 0, err
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, fmt.Errorf("%s must be a finite number", name)
+	}
+	return value, nil
+}
+
 // Global database variable
 var (
-	db  *bbolt.DB
-	rdb *redis.Client
-	ctx = context.Background()  // Global context
+	db         *bbolt.DB
+	colorCache ColorCache
+	ctx        = context.Background()  // Global context
 )
 
-func init() {
+// setupServer checks the environment and opens everything the server needs
+func setupServer() {
+	envErr := loadEnv()
+
+	// Set up the log format and level before anything else logs
+	if err := initLogging(); err != nil {
+		fatal("Failed to configure logging", err)
+	}
+	if envErr != nil {
+		slog.Warn("Error loading .env file", "err", envErr)
+	}
+
 	// Check environment variables
 	if err := checkEnv(); err != nil {
-		log.Fatalf("Environment setup error: %v", err)
+		fatal("Environment setup error", err)
+	}
+
+	// Set up the keys that encrypt sessions at rest
+	var err error
+	sessionCipher, err = NewSessionCipher(os.Getenv("SESSION_ENCRYPTION_KEYS"))
+	if err != nil {
+		fatal("Failed to configure session encryption", err)
+	}
+
+	// Initialize the database
+	db, err = InitDB()
+	if err != nil {
+		fatal("Failed to initialize database", err)
+	}
+
+	// Initialize the album color cache
+	colorCache, err = NewColorCache(os.Getenv("CACHE_BACKEND"))
+	if err != nil {
+		fatal("Failed to initialize color cache", err)
 	}
 
-	// Initialize Redis client
-	opt, _ := redis.ParseURL(os.Getenv("REDIS_URI"))
-	rdb = redis.NewClient(opt)
+	if err := setupClients(); err != nil {
+		fatal("Failed to configure clients", err)
+	}
 
-	// Test Redis connection
-	if err := rdb.Ping(ctx).Err(); err != nil {
-		log.Fatalf("Failed to connect to Redis: %v", err)
+	appTokensEnabled = os.Getenv("SPOTIFY_CLIENT_SECRET") != ""
+}
+
+// setupClients configures the Spotify client and cover downloads, which the server
+// and one-shot commands both use
+func setupClients() error {
+	// Configure the shared Spotify client's base URL and rate limits
+	if err := configureSpotifyClient(); err != nil {
+		return err
 	}
-	fmt.Println("Connected to Redis!")
+
+	// Initialize the cover download pool and client
+	return initImageFetching()
 }
 
-// checkEnv loads the environment variables and verifies required variables exist
-func checkEnv() error {
+// loadEnv loads the .env file from the current or server/ directory, if there is one.
+// It doesn't log, since logging is configured from the variables it loads.
+func loadEnv() error {
 	// Try to load .env file from current directory
 	err := godotenv.Load()
 	if err != nil {
-		log.Printf("Warning: Error loading .env file from current directory: %v", err)
 		// Try looking for .env in the server directory
-		err = godotenv.Load("server/.env")
-		if err != nil {
-			log.Printf("Warning: Error loading .env file from server/ directory: %v", err)
+		if serverErr := godotenv.Load("server/.env"); serverErr != nil {
+			return errors.Join(err, serverErr)
 		}
 	}
+	return nil
+}
 
+// checkEnv verifies required variables exist
+func checkEnv() error {
 	// Check for required environment variables
-	requiredEnvVars := []string{"SPOTIFY_CLIENT_ID", "SPOTIFY_CLIENT_SECRET", "REDIRECT_URI", "FRONTEND_URL", "REDIS_URI"}
+	requiredEnvVars := []string{"SPOTIFY_CLIENT_ID", "REDIRECT_URI", "FRONTEND_URL", "SESSION_SECRET", "SESSION_ENCRYPTION_KEYS"}
+	// PKCE logins don't need the client secret
+	if !usePKCE() {
+		requiredEnvVars = append(requiredEnvVars, "SPOTIFY_CLIENT_SECRET")
+	}
+	// Redis is only needed when it backs the color cache
+	if backend := os.Getenv("CACHE_BACKEND"); backend == "" || backend == "redis" {
+		requiredEnvVars = append(requiredEnvVars, "REDIS_URI")
+	}
 	missingVars := []string{}
 
 	for _, envVar := range requiredEnvVars {
@@ -396,21 +732,45 @@ func checkEnv() error {
 		return fmt.Errorf("missing required environment variables: %v", missingVars)
 	}
 
+	if _, err := cookieSameSite(); err != nil {
+		return err
+	}
+
 	// Get global variables from environment
-	log.Printf("Using frontend URL: %s", os.Getenv("FRONTEND_URL"))
+	slog.Info("Using frontend URL", "url", os.Getenv("FRONTEND_URL"))
 
 	return nil
 }
 
 func main() {
-	// Initialize the database
-	var err error
-	db, err = InitDB()
-	if err != nil {
-		log.Fatalf("Failed to initialize database: %v", err)
+	// Subcommands run once and exit instead of starting the server
+	if len(os.Args) > 1 && os.Args[1] == "poster" {
+		os.Exit(runPosterCommand(os.Args[2:]))
 	}
+
+	// Check the environment and open the session store and color cache
+	setupServer()
 	defer db.Close()
-	defer rdb.Close()
+	defer colorCache.Close()
+
+	// Bring sessions written before encryption, or sealed with a key being rotated
+	// out, onto the current key
+	reencrypted, err := ReencryptSessions(db, sessionCipher)
+	if err != nil {
+		fatal("Failed to re-encrypt sessions", err)
+	}
+	if reencrypted > 0 {
+		slog.Info("Re-encrypted sessions with the current key", "count", reencrypted)
+	}
+
+	// Sessions written before the expiry index existed need an entry for the refresher
+	indexed, err := IndexSessionExpiries(db)
+	if err != nil {
+		fatal("Failed to index session expiries", err)
+	}
+	if indexed > 0 {
+		slog.Info("Indexed session expiries", "count", indexed)
+	}
 
 	// Start a goroutine to clean up expired sessions periodically
 	go func() {
@@ -418,11 +778,25 @@ func main() {
 		defer ticker.Stop()
 		for range ticker.C {
 			if err := CleanupExpiredSessions(db); err != nil {
-				log.Printf("Error cleaning up expired sessions: %v", err)
+				slog.Error("Error cleaning up expired sessions", "err", err)
+			}
+			if err := CleanupExpiredOAuthStates(db); err != nil {
+				slog.Error("Error cleaning up expired login states", "err", err)
 			}
 		}
 	}()
 
+	// Refresh user tokens before they expire so requests don't wait on Spotify
+	go RunTokenRefresher(db)
+
+	// Keep the app token for logged out visitors fresh
+	if appTokensEnabled {
+		go appTokens.RunRefresher()
+	}
+
+	// Recompute colors cached by older versions of the extractor in the background
+	go RunRecomputeWorker()
+
 	// Create file server for the entire build directory
 	fs := http.FileServer(http.Dir("../frontend/build"))
 
@@ -433,10 +807,18 @@ func main() {
 	http.HandleFunc("/user", user)
 	http.HandleFunc("/logout", logout)
 	http.HandleFunc("/playlist/", playlistTracks)
+	http.HandleFunc("/resolve", resolvePlaylist)
+	http.HandleFunc("/library/albums", savedAlbums)
+	http.HandleFunc("/library/tracks", savedTracks)
+	http.HandleFunc("/artist/", artistAlbums)
+	http.HandleFunc("/album/", albumTracks)
+	http.HandleFunc("/top", topColors)
+	http.HandleFunc("/recent", recentPlays)
+	http.HandleFunc("/now-playing", nowPlaying)
 
 	// Serve the frontend app
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		fmt.Printf("Request for path: %s\n", r.URL.Path)
+		loggerFrom(r.Context()).Debug("Request for path", "path", r.URL.Path)
 
 		// Check if the file exists in the build directory
 		path := "../frontend/build" + r.URL.Path
@@ -444,7 +826,7 @@ func main() {
 
 		// If the file exists, serve it directly
 		if err == nil {
-			fmt.Printf("Serving static file: %s\n", path)
+			loggerFrom(r.Context()).Debug("Serving static file", "path", path)
 			fs.ServeHTTP(w, r)
 			return
 		}
@@ -453,17 +835,18 @@ func main() {
 		if strings.HasPrefix(r.URL.Path, "/static/") ||
 		   strings.HasSuffix(r.URL.Path, ".ico") ||
 		   strings.HasSuffix(r.URL.Path, ".json") {
-			fmt.Printf("File not found: %s\n", path)
+			loggerFrom(r.Context()).Debug("File not found", "path", path)
 			http.NotFound(w, r)
 			return
 		}
 
 		// For all other requests, serve the React app's index.html (SPA support)
-		fmt.Printf("Serving SPA for path: %s\n", r.URL.Path)
+		loggerFrom(r.Context()).Debug("Serving SPA for path", "path", r.URL.Path)
 		http.ServeFile(w, r, "../frontend/build/index.html")
 	})
 
-	log.Println("Server starting on port 3026...")
-	log.Println("Serving frontend from ../frontend/build")
-	http.ListenAndServe(":3026", nil)
+	slog.Info("Server starting", "port", 3026, "frontend", "../frontend/build")
+	if err := http.ListenAndServe(":3026", withRequestID(withOriginCheck(http.DefaultServeMux))); err != nil {
+		fatal("Server stopped", err)
+	}
 }
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"time"
+
+	"spotify-vis/spotify"
+)
+
+const (
+	// NowPlayingMinPoll keeps a poll landing right at a track change from spinning
+	NowPlayingMinPoll = 1 * time.Second
+	// NowPlayingMaxPoll bounds how late a skip to the next track is noticed
+	NowPlayingMaxPoll = 10 * time.Second
+	// NowPlayingIdlePoll is how often an idle or paused player is checked
+	NowPlayingIdlePoll = 15 * time.Second
+	// nowPlayingSlack gives Spotify a moment to switch over after a track ends
+	nowPlayingSlack = 500 * time.Millisecond
+)
+
+// NowPlaying is the payload of a now-playing event. Item is nil when nothing is playing.
+type NowPlaying struct {
+	IsPlaying  bool           `json:"isPlaying"`
+	ProgressMs int            `json:"progressMs"`
+	DurationMs int            `json:"durationMs"`
+	Item       *ProcessedItem `json:"item"`
+}
+
+// nextPollDelay waits out the rest of the current track, within NowPlayingMinPoll and
+// NowPlayingMaxPoll, or NowPlayingIdlePoll when nothing is playing
+func nextPollDelay(playing *spotify.CurrentlyPlaying) time.Duration {
+	if playing == nil || !playing.IsPlaying || playing.Item == nil {
+		return NowPlayingIdlePoll
+	}
+
+	remaining := time.Duration(playing.Item.DurationMs-playing.ProgressMs)*time.Millisecond + nowPlayingSlack
+	return max(NowPlayingMinPoll, min(NowPlayingMaxPoll, remaining))
+}
+
+// Endpoint handler for /now-playing. Polls the session's player and emits a
+// "now-playing" event with a NowPlaying payload whenever the track changes or
+// playback starts or stops. Failures that end the stream are sent as an "error" event.
+func nowPlaying(w http.ResponseWriter, r *http.Request) {
+	loggerFrom(r.Context()).Debug("Running handler", "handler", "/now-playing")
+
+	// Add CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", os.Getenv("FRONTEND_URL"))
+	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+
+	// Handle preflight OPTIONS request
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if _, ok := requireSession(w, r); !ok {
+		return
+	}
+	sessionID := sessionIDFromRequest(r)
+
+	sse, ok := newSSEWriter(w)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	var last *NowPlaying
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			loggerFrom(r.Context()).Debug("Client disconnected from now playing stream")
+			return
+		case <-timer.C:
+		}
+
+		// Reload the session every poll, the stream easily outlives an access token
+		session, err := GetSession(db, sessionID)
+		if err != nil {
+			loggerFrom(r.Context()).Warn("Error retrieving session", "err", err)
+			sse.Send("error", map[string]string{"error": "Invalid or expired session"})
+			return
+		}
+
+		playing, err := spotifyClient.CurrentlyPlaying(r.Context(), session.Token.AccessToken)
+		if err != nil {
+			if r.Context().Err() != nil {
+				return
+			}
+			if spotifyStatus(err) == http.StatusUnauthorized || spotifyStatus(err) == http.StatusForbidden {
+				loggerFrom(r.Context()).Error("Error getting currently playing track", "err", err)
+				sse.Send("error", map[string]string{"error": "Not allowed to read playback state"})
+				return
+			}
+			// Anything else is likely a hiccup on Spotify's end, try again later
+			loggerFrom(r.Context()).Warn("Error getting currently playing track", "err", err)
+			timer.Reset(NowPlayingIdlePoll)
+			continue
+		}
+
+		current := &NowPlaying{}
+		// Episodes and ads have no album cover to work with, treat them as nothing playing
+		if playing != nil && playing.Item != nil && playing.CurrentlyPlayingType == "track" {
+			current.IsPlaying = playing.IsPlaying
+			current.ProgressMs = playing.ProgressMs
+			current.DurationMs = playing.Item.DurationMs
+
+			if last != nil && last.Item != nil && last.Item.Track.ID == playing.Item.ID {
+				current.Item = last.Item
+			} else {
+				items := HandoffItemsForImageProcessing(r.Context(), []TrackItem{NewTrackItem(*playing.Item)})
+				if r.Context().Err() != nil {
+					return
+				}
+				current.Item = &items[0]
+			}
+		}
+
+		if last == nil || nowPlayingChanged(last, current) {
+			if err := sse.Send("now-playing", current); err != nil {
+				loggerFrom(r.Context()).Debug("Error writing stream event", "err", err)
+				return
+			}
+		} else if err := sse.Ping(); err != nil {
+			return
+		}
+		last = current
+
+		timer.Reset(nextPollDelay(playing))
+	}
+}
+
+// nowPlayingChanged reports whether the track or the play/pause state differs
+func nowPlayingChanged(a, b *NowPlaying) bool {
+	if a.IsPlaying != b.IsPlaying || (a.Item == nil) != (b.Item == nil) {
+		return true
+	}
+	return a.Item != nil && a.Item.Track.ID != b.Item.Track.ID
+}
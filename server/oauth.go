@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+const (
+	// OAuthStateBucket holds the pending login attempts, keyed by state
+	OAuthStateBucket = "oauth_states"
+	// OAuthStateTTL is how long a user has to finish logging in with Spotify
+	OAuthStateTTL = 10 * time.Minute
+	// oauthStateCookie ties a login attempt to the browser that started it
+	oauthStateCookie = "spotify_auth_state"
+)
+
+// OAuthState is one login attempt that has been sent to Spotify but not come back yet
+type OAuthState struct {
+	State string `json:"state"`
+	// CodeVerifier is the PKCE secret whose hash was sent as the code_challenge
+	CodeVerifier string    `json:"code_verifier,omitempty"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+// usePKCE reports whether logins use PKCE, which lets deployments leave out the client secret
+func usePKCE() bool {
+	return os.Getenv("SPOTIFY_USE_PKCE") == "true"
+}
+
+// randomToken returns n random bytes encoded as unpadded base64url, which is safe for
+// both URLs and PKCE verifiers
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// pkceChallenge derives the S256 code_challenge for a code_verifier
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// NewOAuthState stores a fresh login attempt, with a PKCE verifier when withVerifier is set
+func NewOAuthState(db *bbolt.DB, withVerifier bool) (*OAuthState, error) {
+	state, err := randomToken(32)
+	if err != nil {
+		return nil, fmt.Errorf("could not generate state: %v", err)
+	}
+	oauthState := &OAuthState{State: state, ExpiresAt: time.Now().Add(OAuthStateTTL)}
+
+	if withVerifier {
+		// 64 bytes encode to 86 characters, inside the 43 to 128 PKCE allows
+		oauthState.CodeVerifier, err = randomToken(64)
+		if err != nil {
+			return nil, fmt.Errorf("could not generate code verifier: %v", err)
+		}
+	}
+
+	stateJSON, err := json.Marshal(oauthState)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal state: %v", err)
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(OAuthStateBucket)).Put([]byte(state), stateJSON)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not store state: %v", err)
+	}
+
+	return oauthState, nil
+}
+
+// ConsumeOAuthState looks up and deletes a login attempt, so every state can only be
+// used once. Unknown and expired states are errors.
+func ConsumeOAuthState(db *bbolt.DB, state string) (*OAuthState, error) {
+	var oauthState OAuthState
+	err := db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(OAuthStateBucket))
+		data := b.Get([]byte(state))
+		if data == nil {
+			return fmt.Errorf("unknown state")
+		}
+		if err := json.Unmarshal(data, &oauthState); err != nil {
+			return fmt.Errorf("could not unmarshal state: %v", err)
+		}
+		return b.Delete([]byte(state))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if time.Now().After(oauthState.ExpiresAt) {
+		return nil, fmt.Errorf("state expired")
+	}
+
+	return &oauthState, nil
+}
+
+// CleanupExpiredOAuthStates removes login attempts that were never finished
+func CleanupExpiredOAuthStates(db *bbolt.DB) error {
+	return db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(OAuthStateBucket))
+
+		// Deleting while iterating skips keys, so collect them first
+		var expired [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			var oauthState OAuthState
+			if err := json.Unmarshal(v, &oauthState); err != nil || time.Now().After(oauthState.ExpiresAt) {
+				expired = append(expired, append([]byte{}, k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// setOAuthStateCookie remembers the state in the browser. It has to be Lax rather
+// than Strict so it comes along on the redirect back from Spotify.
+func setOAuthStateCookie(w http.ResponseWriter, state string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthStateCookie,
+		Value:    state,
+		Path:     "/",
+		MaxAge:   int(OAuthStateTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   cookieSecure(),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// clearOAuthStateCookie drops the state cookie once a login attempt is over
+func clearOAuthStateCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthStateCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   cookieSecure(),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
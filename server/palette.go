@@ -0,0 +1,218 @@
+package main
+
+import (
+	"image"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+const (
+	// PaletteSize is the number of dominant colors extracted per cover
+	PaletteSize = 5
+	// paletteIterations bounds the number of k-means refinement passes
+	paletteIterations = 10
+	// paletteSeed seeds center selection so palettes are reproducible
+	paletteSeed = 1
+)
+
+// PaletteColor is one dominant color and the share of pixels closest to it
+type PaletteColor struct {
+	Color  Color   `json:"color"`
+	Weight float64 `json:"weight"`
+}
+
+// ComputePalette clusters the pixels of img with k-means in OKLab space and returns
+// up to n dominant colors sorted by weight, heaviest first
+func ComputePalette(img image.Image, n int) []PaletteColor {
+	bounds := img.Bounds()
+	pixels := make([]OKLab, 0, bounds.Dx()*bounds.Dy())
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			pixels = append(pixels, Color{R: int(r >> 8), G: int(g >> 8), B: int(b >> 8)}.ToOKLab())
+		}
+	}
+
+	return clusterPalette(pixels, nil, n)
+}
+
+// AggregatePalette merges several palettes into up to n dominant colors. Each palette
+// counts equally, with its colors weighted by their share of that palette.
+func AggregatePalette(palettes [][]PaletteColor, n int) []PaletteColor {
+	points := []OKLab{}
+	weights := []float64{}
+	for _, palette := range palettes {
+		total := 0.0
+		for _, p := range palette {
+			total += p.Weight
+		}
+		if total == 0 {
+			continue
+		}
+		for _, p := range palette {
+			points = append(points, p.Color.ToOKLab())
+			weights = append(weights, p.Weight/total)
+		}
+	}
+
+	return clusterPalette(points, weights, n)
+}
+
+// clusterPalette runs k-means over points and returns up to n centers weighted by
+// their share of the total, heaviest first. A nil weights counts every point once.
+func clusterPalette(points []OKLab, weights []float64, n int) []PaletteColor {
+	if len(points) == 0 || n <= 0 {
+		return []PaletteColor{}
+	}
+	if weights == nil {
+		weights = make([]float64, len(points))
+		for i := range weights {
+			weights[i] = 1
+		}
+	}
+
+	centers := initCenters(points, weights, n)
+	assignments := make([]int, len(points))
+
+	for iter := 0; iter < paletteIterations; iter++ {
+		// Assign every point to its nearest center
+		changed := false
+		for i, p := range points {
+			nearest := nearestCenter(p, centers)
+			if nearest != assignments[i] || iter == 0 {
+				changed = true
+			}
+			assignments[i] = nearest
+		}
+		if !changed {
+			break
+		}
+
+		// Move each center to the weighted mean of its points
+		sums := make([]OKLab, len(centers))
+		totals := make([]float64, len(centers))
+		for i, p := range points {
+			c, w := assignments[i], weights[i]
+			sums[c].L += p.L * w
+			sums[c].A += p.A * w
+			sums[c].B += p.B * w
+			totals[c] += w
+		}
+		for c := range centers {
+			if totals[c] == 0 {
+				continue
+			}
+			centers[c] = OKLab{
+				L: sums[c].L / totals[c],
+				A: sums[c].A / totals[c],
+				B: sums[c].B / totals[c],
+			}
+		}
+	}
+
+	totals := make([]float64, len(centers))
+	total := 0.0
+	for i, c := range assignments {
+		totals[c] += weights[i]
+		total += weights[i]
+	}
+
+	palette := []PaletteColor{}
+	for c, center := range centers {
+		if totals[c] == 0 {
+			continue
+		}
+		palette = append(palette, PaletteColor{
+			Color:  center.ToColor(),
+			Weight: totals[c] / total,
+		})
+	}
+	sort.SliceStable(palette, func(i, j int) bool { return palette[i].Weight > palette[j].Weight })
+
+	return palette
+}
+
+// initCenters seeds k-means with k-means++, starting from the pixel closest to the
+// weighted mean. Each further center is picked with a chance that grows with its
+// weighted squared distance from the centers so far, so distinct colors are likely
+// picked but a handful of outlier pixels rarely are. The RNG has a fixed seed, so the
+// same pixels always give the same palette.
+func initCenters(pixels []OKLab, weights []float64, n int) []OKLab {
+	var mean OKLab
+	total := 0.0
+	for i, p := range pixels {
+		mean.L += p.L * weights[i]
+		mean.A += p.A * weights[i]
+		mean.B += p.B * weights[i]
+		total += weights[i]
+	}
+	if total > 0 {
+		mean = OKLab{L: mean.L / total, A: mean.A / total, B: mean.B / total}
+	}
+
+	first := pixels[0]
+	for _, p := range pixels {
+		if okDistSq(p, mean) < okDistSq(first, mean) {
+			first = p
+		}
+	}
+	centers := []OKLab{first}
+
+	// Track how far each pixel is from its nearest chosen center
+	dists := make([]float64, len(pixels))
+	for i, p := range pixels {
+		dists[i] = okDistSq(p, first)
+	}
+
+	rng := rand.New(rand.NewSource(paletteSeed))
+	for len(centers) < n {
+		sum := 0.0
+		for i := range pixels {
+			sum += dists[i] * weights[i]
+		}
+		// Every pixel already sits on a center, so there are no more distinct colors
+		if sum == 0 {
+			break
+		}
+
+		// Walk the cumulative weights until passing a random point along them
+		target := rng.Float64() * sum
+		picked := -1
+		for i := range pixels {
+			if dists[i]*weights[i] == 0 {
+				continue
+			}
+			picked = i
+			target -= dists[i] * weights[i]
+			if target <= 0 {
+				break
+			}
+		}
+
+		center := pixels[picked]
+		centers = append(centers, center)
+		for i, p := range pixels {
+			dists[i] = math.Min(dists[i], okDistSq(p, center))
+		}
+	}
+
+	return centers
+}
+
+func nearestCenter(p OKLab, centers []OKLab) int {
+	nearest := 0
+	best := math.Inf(1)
+	for c, center := range centers {
+		if d := okDistSq(p, center); d < best {
+			best = d
+			nearest = c
+		}
+	}
+	return nearest
+}
+
+func okDistSq(a, b OKLab) float64 {
+	dl, da, db := a.L-b.L, a.A-b.A, a.B-b.B
+	return dl*dl + da*da + db*db
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+// stripedImage fills a 100 pixel wide image with bands of each color, rows[i] rows tall
+func stripedImage(colors []color.RGBA, rows []int) *image.RGBA {
+	height := 0
+	for _, r := range rows {
+		height += r
+	}
+	img := image.NewRGBA(image.Rect(0, 0, 100, height))
+	y := 0
+	for i, c := range colors {
+		for end := y + rows[i]; y < end; y++ {
+			for x := 0; x < 100; x++ {
+				img.SetRGBA(x, y, c)
+			}
+		}
+	}
+	return img
+}
+
+func assertPaletteColor(t *testing.T, got PaletteColor, want Color, wantWeight float64) {
+	t.Helper()
+	if d := DeltaEOK(got.Color.ToOKLab(), want.ToOKLab()); d > 0.02 {
+		t.Errorf("palette color %s, want close to %s (delta E %.3f)", got.Color.ToHex(), want.ToHex(), d)
+	}
+	if math.Abs(got.Weight-wantWeight) > 0.01 {
+		t.Errorf("palette color %s has weight %.3f, want %.3f", got.Color.ToHex(), got.Weight, wantWeight)
+	}
+}
+
+func TestComputePaletteOrdersByWeight(t *testing.T) {
+	img := stripedImage(
+		[]color.RGBA{{0, 0, 200, 255}, {220, 30, 30, 255}, {240, 240, 240, 255}},
+		[]int{20, 50, 30},
+	)
+
+	palette := ComputePalette(img, 3)
+
+	if len(palette) != 3 {
+		t.Fatalf("got %d palette colors, want 3", len(palette))
+	}
+	assertPaletteColor(t, palette[0], Color{R: 220, G: 30, B: 30}, 0.5)
+	assertPaletteColor(t, palette[1], Color{R: 240, G: 240, B: 240}, 0.3)
+	assertPaletteColor(t, palette[2], Color{R: 0, G: 0, B: 200}, 0.2)
+}
+
+func TestComputePaletteIgnoresOutliers(t *testing.T) {
+	img := stripedImage(
+		[]color.RGBA{{128, 0, 0, 255}, {0, 0, 128, 255}},
+		[]int{50, 50},
+	)
+	// A single bright pixel, like JPEG noise or a small logo
+	img.SetRGBA(0, 0, color.RGBA{255, 255, 0, 255})
+
+	palette := ComputePalette(img, 2)
+
+	if len(palette) != 2 {
+		t.Fatalf("got %d palette colors, want 2", len(palette))
+	}
+	for _, p := range palette {
+		if p.Weight < 0.4 {
+			t.Errorf("palette color %s has weight %.4f, an outlier made it into the palette", p.Color.ToHex(), p.Weight)
+		}
+	}
+}
+
+func TestComputePaletteIsDeterministic(t *testing.T) {
+	img := stripedImage(
+		[]color.RGBA{{10, 120, 40, 255}, {200, 180, 20, 255}, {90, 20, 160, 255}, {30, 30, 30, 255}},
+		[]int{10, 20, 30, 40},
+	)
+
+	first := ComputePalette(img, PaletteSize)
+	for i := 0; i < 5; i++ {
+		again := ComputePalette(img, PaletteSize)
+		if len(again) != len(first) {
+			t.Fatalf("got %d palette colors, then %d", len(first), len(again))
+		}
+		for j := range first {
+			if again[j] != first[j] {
+				t.Fatalf("palette changed between runs: %v, then %v", first, again)
+			}
+		}
+	}
+}
+
+func TestComputePaletteSolidImage(t *testing.T) {
+	img := stripedImage([]color.RGBA{{50, 100, 150, 255}}, []int{10})
+
+	palette := ComputePalette(img, PaletteSize)
+
+	// There is only one distinct color, so only one center is seeded
+	if len(palette) != 1 {
+		t.Fatalf("got %d palette colors, want 1", len(palette))
+	}
+	assertPaletteColor(t, palette[0], Color{R: 50, G: 100, B: 150}, 1)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultImageWorkers is how many covers can be downloaded and processed at once
+	DefaultImageWorkers = 16
+)
+
+// imagePool bounds cover downloads across every request, initialized by initImageFetching
+var imagePool *WorkerPool
+
+// WorkerPool runs jobs with a fixed limit on how many run at the same time,
+// shared by every caller of Run
+type WorkerPool struct {
+	slots chan struct{}
+}
+
+// NewWorkerPool creates a pool running at most size jobs at once
+func NewWorkerPool(size int) *WorkerPool {
+	return &WorkerPool{slots: make(chan struct{}, size)}
+}
+
+// Run calls fn(i) for every i in [0, n) and waits for them to finish. Jobs only get a
+// goroutine once a slot frees up, and no new jobs start after ctx is done.
+func (p *WorkerPool) Run(ctx context.Context, n int, fn func(i int)) {
+	var wg sync.WaitGroup
+
+	for i := 0; i < n; i++ {
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return
+		case p.slots <- struct{}{}:
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-p.slots
+				wg.Done()
+			}()
+			fn(i)
+		}(i)
+	}
+
+	wg.Wait()
+}
+
+// initImageFetching sizes imagePool from IMAGE_WORKERS and the download timeout from IMAGE_FETCH_TIMEOUT
+func initImageFetching() error {
+	workers := DefaultImageWorkers
+	if raw := os.Getenv("IMAGE_WORKERS"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed <= 0 {
+			return fmt.Errorf("invalid IMAGE_WORKERS: %q", raw)
+		}
+		workers = parsed
+	}
+	imagePool = NewWorkerPool(workers)
+
+	if raw := os.Getenv("IMAGE_FETCH_TIMEOUT"); raw != "" {
+		timeout, err := time.ParseDuration(raw)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("invalid IMAGE_FETCH_TIMEOUT: %q", raw)
+		}
+		imageClient.Timeout = timeout
+	}
+
+	return nil
+}
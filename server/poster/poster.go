@@ -0,0 +1,159 @@
+// Package poster renders placed album covers to a PNG or a self-contained SVG.
+package poster
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"math"
+)
+
+// Tile is one cover centered at X, Y with edge length Size, in canvas pixels
+type Tile struct {
+	X     float64
+	Y     float64
+	Size  float64
+	Image image.Image
+}
+
+// Options describes the canvas the tiles are drawn on
+type Options struct {
+	Width      int
+	Height     int
+	Background color.RGBA
+}
+
+// RenderPNG draws the tiles in order, later tiles on top, and encodes the result as PNG
+func RenderPNG(w io.Writer, tiles []Tile, opts Options) error {
+	canvas := image.NewRGBA(image.Rect(0, 0, opts.Width, opts.Height))
+	draw.Draw(canvas, canvas.Bounds(), &image.Uniform{C: opts.Background}, image.Point{}, draw.Src)
+
+	for _, tile := range tiles {
+		if tile.Image == nil {
+			continue
+		}
+		drawScaled(canvas, tileRect(tile), tile.Image)
+	}
+
+	return png.Encode(w, canvas)
+}
+
+// RenderSVG writes an SVG with every cover embedded as a PNG data URI, so the
+// file renders without access to Spotify's CDN
+func RenderSVG(w io.Writer, tiles []Tile, opts Options) error {
+	bg := opts.Background
+	_, err := fmt.Fprintf(w,
+		`<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d">`+"\n"+
+			`<rect width="100%%" height="100%%" fill="#%02x%02x%02x"/>`+"\n",
+		opts.Width, opts.Height, opts.Width, opts.Height, bg.R, bg.G, bg.B)
+	if err != nil {
+		return err
+	}
+
+	for _, tile := range tiles {
+		if tile.Image == nil {
+			continue
+		}
+
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, tile.Image); err != nil {
+			return err
+		}
+		_, err := fmt.Fprintf(w,
+			`<image x="%.1f" y="%.1f" width="%.1f" height="%.1f" preserveAspectRatio="none" href="data:image/png;base64,%s"/>`+"\n",
+			tile.X-tile.Size/2, tile.Y-tile.Size/2, tile.Size, tile.Size,
+			base64.StdEncoding.EncodeToString(buf.Bytes()))
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = io.WriteString(w, "</svg>\n")
+	return err
+}
+
+// ParseHexColor parses "#rrggbb" (the leading # is optional) into an opaque color
+func ParseHexColor(hex string) (color.RGBA, error) {
+	if len(hex) > 0 && hex[0] == '#' {
+		hex = hex[1:]
+	}
+
+	var r, g, b uint8
+	if len(hex) != 6 {
+		return color.RGBA{}, fmt.Errorf("invalid hex color: %q", hex)
+	}
+	if _, err := fmt.Sscanf(hex, "%02x%02x%02x", &r, &g, &b); err != nil {
+		return color.RGBA{}, fmt.Errorf("invalid hex color: %q", hex)
+	}
+
+	return color.RGBA{R: r, G: g, B: b, A: 255}, nil
+}
+
+func tileRect(tile Tile) image.Rectangle {
+	x0 := int(math.Round(tile.X - tile.Size/2))
+	y0 := int(math.Round(tile.Y - tile.Size/2))
+	size := int(math.Round(tile.Size))
+	return image.Rect(x0, y0, x0+size, y0+size)
+}
+
+// drawScaled bilinearly resamples src into rect on dst, clipped to dst's bounds
+func drawScaled(dst *image.RGBA, rect image.Rectangle, src image.Image) {
+	sb := src.Bounds()
+	if sb.Empty() || rect.Empty() {
+		return
+	}
+	scaleX := float64(sb.Dx()) / float64(rect.Dx())
+	scaleY := float64(sb.Dy()) / float64(rect.Dy())
+
+	clip := rect.Intersect(dst.Bounds())
+	for y := clip.Min.Y; y < clip.Max.Y; y++ {
+		// Sample at pixel centers, mapped back into source coordinates
+		sy := (float64(y-rect.Min.Y)+0.5)*scaleY - 0.5
+		for x := clip.Min.X; x < clip.Max.X; x++ {
+			sx := (float64(x-rect.Min.X)+0.5)*scaleX - 0.5
+			dst.SetRGBA(x, y, bilinear(src, sb, sx, sy))
+		}
+	}
+}
+
+func bilinear(src image.Image, sb image.Rectangle, sx, sy float64) color.RGBA {
+	x0 := int(math.Floor(sx))
+	y0 := int(math.Floor(sy))
+	fx := sx - float64(x0)
+	fy := sy - float64(y0)
+
+	var r, g, b float64
+	for _, s := range [4]struct {
+		dx, dy int
+		w      float64
+	}{
+		{0, 0, (1 - fx) * (1 - fy)},
+		{1, 0, fx * (1 - fy)},
+		{0, 1, (1 - fx) * fy},
+		{1, 1, fx * fy},
+	} {
+		px := clampInt(sb.Min.X+x0+s.dx, sb.Min.X, sb.Max.X-1)
+		py := clampInt(sb.Min.Y+y0+s.dy, sb.Min.Y, sb.Max.Y-1)
+		cr, cg, cb, _ := src.At(px, py).RGBA()
+		r += float64(cr>>8) * s.w
+		g += float64(cg>>8) * s.w
+		b += float64(cb>>8) * s.w
+	}
+
+	return color.RGBA{R: uint8(math.Round(r)), G: uint8(math.Round(g)), B: uint8(math.Round(b)), A: 255}
+}
+
+func clampInt(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"time"
+
+	"spotify-vis/spotify"
+)
+
+const (
+	// RecentPageSize is the most plays Spotify returns per recently played page
+	RecentPageSize = 50
+	// RecentMaxPages bounds how far back through the play history /recent pages
+	RecentMaxPages = 10
+)
+
+// RecentPlay is one play with the colors of its album
+type RecentPlay struct {
+	PlayedAt    time.Time `json:"playedAt"`
+	Track       TrackItem `json:"track"`
+	AvgColor    Color     `json:"avgColor"`
+	CommonColor Color     `json:"commonColor"`
+	// Unavailable is set when the album cover couldn't be loaded
+	Unavailable bool `json:"unavailable,omitempty"`
+}
+
+// RecentBucket groups the plays that started within one hour or day, oldest first
+type RecentBucket struct {
+	Start time.Time    `json:"start"`
+	Plays []RecentPlay `json:"plays"`
+	// AvgColor is the OKLab mean of the plays' average colors
+	AvgColor Color `json:"avgColor"`
+	// CommonColor is the common color shared by the most plays
+	CommonColor Color `json:"commonColor"`
+}
+
+// GetRecentPlays pages back through the current user's play history and attaches
+// each play's album colors, newest first
+func GetRecentPlays(ctx context.Context, accessToken string) ([]RecentPlay, error) {
+	firstPage, err := spotifyClient.RecentlyPlayed(ctx, accessToken, RecentPageSize)
+	if err != nil {
+		return nil, err
+	}
+	history, err := spotify.AllCursorPages(ctx, spotifyClient, accessToken, firstPage, RecentMaxPages)
+	if err != nil {
+		return nil, err
+	}
+
+	tracks := make([]spotify.Track, len(history))
+	for i, play := range history {
+		tracks[i] = play.Track
+	}
+
+	// Albums get played over and over, so only process each one once
+	processedItems := HandoffItemsForImageProcessing(ctx, UniqueAlbumTracks(tracks))
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	albumColors := make(map[string]ProcessedItem, len(processedItems))
+	for _, item := range processedItems {
+		albumColors[item.Track.Album.ID] = item
+	}
+
+	plays := []RecentPlay{}
+	for _, play := range history {
+		playedAt, err := time.Parse(time.RFC3339, play.PlayedAt)
+		if err != nil {
+			loggerFrom(ctx).Warn("Skipping play with bad timestamp", "played_at", play.PlayedAt, "err", err)
+			continue
+		}
+		colors := albumColors[play.Track.Album.ID]
+		plays = append(plays, RecentPlay{
+			PlayedAt:    playedAt,
+			Track:       NewTrackItem(play.Track),
+			AvgColor:    colors.AvgColor,
+			CommonColor: colors.CommonColor,
+			Unavailable: colors.Unavailable,
+		})
+	}
+
+	return plays, nil
+}
+
+// BucketRecentPlays groups plays by the hour or day (in loc) they started in,
+// returning the buckets oldest first
+func BucketRecentPlays(plays []RecentPlay, bucket string, loc *time.Location) []RecentBucket {
+	buckets := []RecentBucket{}
+	index := make(map[time.Time]int)
+
+	// Plays come newest first, walk them backwards so everything ends up oldest first
+	for i := len(plays) - 1; i >= 0; i-- {
+		play := plays[i]
+		t := play.PlayedAt.In(loc)
+		start := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, loc)
+		if bucket == "day" {
+			start = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+		}
+
+		j, ok := index[start]
+		if !ok {
+			j = len(buckets)
+			index[start] = j
+			buckets = append(buckets, RecentBucket{Start: start, Plays: []RecentPlay{}})
+		}
+		buckets[j].Plays = append(buckets[j].Plays, play)
+	}
+
+	for i := range buckets {
+		avgColors := []Color{}
+		commonCounts := make(map[Color]int)
+		for _, play := range buckets[i].Plays {
+			// Plays without a cover still count in the bucket, just not in its colors
+			if play.Unavailable {
+				continue
+			}
+			avgColors = append(avgColors, play.AvgColor)
+			commonCounts[play.CommonColor]++
+			// Ties go to the color played first
+			if commonCounts[play.CommonColor] > commonCounts[buckets[i].CommonColor] {
+				buckets[i].CommonColor = play.CommonColor
+			}
+		}
+		buckets[i].AvgColor = AverageOKLab(avgColors)
+	}
+
+	return buckets
+}
+
+// Endpoint handler for /recent?bucket=hour|day&tz={IANA zone}
+func recentPlays(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	loggerFrom(r.Context()).Debug("Running handler", "handler", "/recent")
+
+	// Add CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", os.Getenv("FRONTEND_URL"))
+	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+
+	// Handle preflight OPTIONS request
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	bucket := r.URL.Query().Get("bucket")
+	if bucket == "" {
+		bucket = "hour"
+	}
+	if bucket != "hour" && bucket != "day" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": "bucket must be hour or day"}`))
+		return
+	}
+
+	// Days only line up with the listener's calendar in their own time zone
+	loc, err := time.LoadLocation(r.URL.Query().Get("tz"))
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": "Unknown time zone"}`))
+		return
+	}
+
+	session, ok := requireSession(w, r)
+	if !ok {
+		return
+	}
+
+	plays, err := GetRecentPlays(r.Context(), session.Token.AccessToken)
+	if err != nil {
+		loggerFrom(r.Context()).Error("Error getting recently played tracks", "err", err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error": "Failed to fetch recently played tracks"}`))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(BucketRecentPlays(plays, bucket, loc))
+
+	loggerFrom(r.Context()).Debug("Recent function finished", "elapsed", time.Since(start))
+}
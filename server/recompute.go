@@ -0,0 +1,61 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+)
+
+const (
+	// RecomputeQueueSize is how many stale albums can wait for recomputation
+	RecomputeQueueSize = 1000
+)
+
+// staleAlbum is an album whose cached colors came from an older ColorAlgorithmVersion
+type staleAlbum struct {
+	AlbumID string
+	Image   SpotifyImage
+}
+
+var (
+	recomputeQueue   = make(chan staleAlbum, RecomputeQueueSize)
+	recomputePending sync.Map // album IDs queued or in progress
+)
+
+// QueueRecompute schedules an album's colors to be recomputed in the background.
+// Albums already queued are ignored, and the request is dropped if the queue is full
+// since the stale entry will be seen (and queued) again on a later request.
+func QueueRecompute(albumID string, image *SpotifyImage) {
+	if image == nil {
+		return
+	}
+	if _, loaded := recomputePending.LoadOrStore(albumID, true); loaded {
+		return
+	}
+
+	select {
+	case recomputeQueue <- staleAlbum{AlbumID: albumID, Image: *image}:
+	default:
+		recomputePending.Delete(albumID)
+	}
+}
+
+// RunRecomputeWorker processes stale albums from the queue until it is closed
+func RunRecomputeWorker() {
+	for album := range recomputeQueue {
+		avgColor, commonColor, palette, err := ProcessImage(ctx, &album.Image)
+		if err != nil {
+			// Keep serving the stale entry, it will be queued again on a later request
+			slog.Warn("Error recomputing stale cache entry", "album_id", album.AlbumID, "err", err)
+			recomputePending.Delete(album.AlbumID)
+			continue
+		}
+		err = SetCache([]CacheUpdate{{
+			AlbumID: album.AlbumID,
+			Value:   NewCacheEntry(avgColor, commonColor, palette),
+		}})
+		if err != nil {
+			slog.Error("Error recomputing stale cache entry", "err", err)
+		}
+		recomputePending.Delete(album.AlbumID)
+	}
+}
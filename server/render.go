@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"io"
+
+	"spotify-vis/layout"
+	"spotify-vis/poster"
+)
+
+const (
+	// MaxPosterSize caps the canvas edge, a full RGBA canvas is 4 bytes per pixel
+	MaxPosterSize = 4096
+	// MaxConcurrentPosters bounds how many canvases can be held in memory at once
+	MaxConcurrentPosters = 2
+)
+
+// posterSlots is a semaphore limiting concurrent renders to MaxConcurrentPosters
+var posterSlots = make(chan struct{}, MaxConcurrentPosters)
+
+// PosterOptions controls how a playlist's color wheel is rendered
+type PosterOptions struct {
+	Width      int
+	Height     int
+	Background string // hex color
+	ColorMode  string // "avg" or "common", which color drives placement
+	Format     string // "png" or "svg"
+}
+
+// DefaultPosterOptions matches the frontend's canvas and background
+func DefaultPosterOptions() PosterOptions {
+	return PosterOptions{
+		Width:      DefaultCanvasSize,
+		Height:     DefaultCanvasSize,
+		Background: "#121212",
+		ColorMode:  "avg",
+		Format:     "png",
+	}
+}
+
+// Validate checks the options before any work is done for them
+func (o PosterOptions) Validate() error {
+	if o.Width <= 0 || o.Height <= 0 || o.Width > MaxPosterSize || o.Height > MaxPosterSize {
+		return fmt.Errorf("width and height must be between 1 and %d", MaxPosterSize)
+	}
+	if o.ColorMode != "avg" && o.ColorMode != "common" {
+		return fmt.Errorf("color must be avg or common")
+	}
+	if o.Format != "png" && o.Format != "svg" {
+		return fmt.Errorf("format must be png or svg")
+	}
+	if _, err := poster.ParseHexColor(o.Background); err != nil {
+		return err
+	}
+	return nil
+}
+
+// LayoutItems places the processed albums on a color wheel for the given canvas
+func LayoutItems(items []ProcessedItem, width float64, height float64, colorMode string) []layout.Placement {
+	points := make([]layout.Point, len(items))
+	for i, item := range items {
+		hsv := item.AvgHSV
+		if colorMode == "common" {
+			hsv = item.CommonHSV
+		}
+		points[i] = layout.Point{ID: item.Track.Album.ID, Hue: hsv.H, Saturation: hsv.S}
+	}
+
+	return layout.Compute(points, layout.Options{Width: width, Height: height})
+}
+
+// RenderPoster lays out the processed albums and draws their covers to w
+func RenderPoster(ctx context.Context, w io.Writer, items []ProcessedItem, opts PosterOptions) error {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	// Covers that couldn't be loaded have no colors to place them by
+	items = AvailableItems(items)
+	background, _ := poster.ParseHexColor(opts.Background)
+
+	placements := LayoutItems(items, float64(opts.Width), float64(opts.Height), opts.ColorMode)
+
+	// Covers were usually just downloaded by ProcessImage, so most of these are store hits
+	tiles := make([]poster.Tile, len(items))
+	imagePool.Run(ctx, len(items), func(i int) {
+		var img image.Image
+		if smallestImage := FindSmallestImage(&items[i].Track.Album.Images); smallestImage != nil {
+			cover, err := FetchCover(ctx, smallestImage.URL)
+			if err != nil {
+				loggerFrom(ctx).Warn("Error fetching cover for poster", "err", err)
+			}
+			img = cover
+		}
+
+		tiles[i] = poster.Tile{X: placements[i].X, Y: placements[i].Y, Size: placements[i].Size, Image: img}
+	})
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// Covers are in hand, now wait for a free slot before allocating the canvas
+	select {
+	case posterSlots <- struct{}{}:
+		defer func() { <-posterSlots }()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	posterOpts := poster.Options{Width: opts.Width, Height: opts.Height, Background: background}
+	if opts.Format == "svg" {
+		return poster.RenderSVG(w, tiles, posterOpts)
+	}
+	return poster.RenderPNG(w, tiles, posterOpts)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"go.etcd.io/bbolt"
+)
+
+// minSessionKeyLength keeps obviously weak secrets out of SESSION_ENCRYPTION_KEYS
+const minSessionKeyLength = 16
+
+// sealedSession is how an encrypted session sits in bbolt. The session JSON is
+// encrypted with a fresh data key, and the data key is encrypted ("wrapped") with
+// the key named by KeyID, so rotating keys only needs the data keys rewrapped.
+type sealedSession struct {
+	KeyID      string `json:"kid"`
+	WrappedKey []byte `json:"k"`
+	Ciphertext []byte `json:"c"`
+}
+
+// SessionCipher encrypts session values with the current key and decrypts them with
+// any key it knows, including the plain JSON written before sessions were encrypted
+type SessionCipher struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+// NewSessionCipher parses SESSION_ENCRYPTION_KEYS, a comma separated list of
+// keyID:secret pairs. The first key encrypts, the rest are only kept to decrypt
+// sessions written before a rotation.
+func NewSessionCipher(spec string) (*SessionCipher, error) {
+	c := &SessionCipher{keys: make(map[string]cipher.AEAD)}
+
+	for _, pair := range strings.Split(spec, ",") {
+		keyID, secret, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if !ok || keyID == "" {
+			return nil, fmt.Errorf("session encryption keys must look like id:secret")
+		}
+		if len(secret) < minSessionKeyLength {
+			return nil, fmt.Errorf("session encryption key %q is shorter than %d characters", keyID, minSessionKeyLength)
+		}
+		if _, ok := c.keys[keyID]; ok {
+			return nil, fmt.Errorf("session encryption key %q is listed twice", keyID)
+		}
+
+		aead, err := newGCM(deriveSessionKey(secret))
+		if err != nil {
+			return nil, err
+		}
+		c.keys[keyID] = aead
+		if c.current == "" {
+			c.current = keyID
+		}
+	}
+
+	return c, nil
+}
+
+// deriveSessionKey stretches a secret of any length into an AES-256 key
+func deriveSessionKey(secret string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("spotify-vis session encryption"))
+	return mac.Sum(nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("could not create cipher: %v", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts with aead under a random nonce, which is prepended to the result
+func seal(aead cipher.AEAD, plaintext []byte, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// open reverses seal
+func open(aead cipher.AEAD, sealed []byte, additionalData []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
+
+// Seal encrypts a session's JSON with the current key. The session ID is bound in as
+// additional data, so a sealed value can't be moved to another session's key.
+func (c *SessionCipher) Seal(sessionID string, plaintext []byte) ([]byte, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, fmt.Errorf("could not generate data key: %v", err)
+	}
+	dataAEAD, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext, err := seal(dataAEAD, plaintext, []byte(sessionID))
+	if err != nil {
+		return nil, fmt.Errorf("could not encrypt session: %v", err)
+	}
+	wrappedKey, err := seal(c.keys[c.current], dataKey, []byte(c.current))
+	if err != nil {
+		return nil, fmt.Errorf("could not wrap data key: %v", err)
+	}
+
+	return json.Marshal(sealedSession{KeyID: c.current, WrappedKey: wrappedKey, Ciphertext: ciphertext})
+}
+
+// Open decrypts a stored session value and returns the ID of the key it was sealed
+// with. Plain JSON sessions are passed through with an empty key ID.
+func (c *SessionCipher) Open(sessionID string, stored []byte) ([]byte, string, error) {
+	var sealed sealedSession
+	if err := json.Unmarshal(stored, &sealed); err != nil {
+		return nil, "", fmt.Errorf("could not unmarshal session: %v", err)
+	}
+	if sealed.KeyID == "" {
+		return stored, "", nil
+	}
+
+	keyAEAD, ok := c.keys[sealed.KeyID]
+	if !ok {
+		return nil, "", fmt.Errorf("session sealed with unknown key %q", sealed.KeyID)
+	}
+	dataKey, err := open(keyAEAD, sealed.WrappedKey, []byte(sealed.KeyID))
+	if err != nil {
+		return nil, "", fmt.Errorf("could not unwrap data key: %v", err)
+	}
+	dataAEAD, err := newGCM(dataKey)
+	if err != nil {
+		return nil, "", err
+	}
+	plaintext, err := open(dataAEAD, sealed.Ciphertext, []byte(sessionID))
+	if err != nil {
+		return nil, "", fmt.Errorf("could not decrypt session: %v", err)
+	}
+
+	return plaintext, sealed.KeyID, nil
+}
+
+// ReencryptSessions rewrites every session that isn't sealed with the current key,
+// which covers plain JSON sessions and ones sealed with a key being rotated out.
+// Sessions that can't be decrypted are left alone. Returns how many were rewritten.
+func ReencryptSessions(db *bbolt.DB, c *SessionCipher) (int, error) {
+	count := 0
+	err := db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(SessionBucket))
+
+		// Writing while iterating isn't allowed, so collect the new values first
+		updates := make(map[string][]byte)
+		err := b.ForEach(func(k, v []byte) error {
+			sessionID := string(k)
+			plaintext, keyID, err := c.Open(sessionID, v)
+			if err != nil {
+				return nil // Skip sessions we can't read
+			}
+			if keyID == c.current {
+				return nil
+			}
+
+			sealed, err := c.Seal(sessionID, plaintext)
+			if err != nil {
+				return err
+			}
+			updates[sessionID] = sealed
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for sessionID, sealed := range updates {
+			if err := b.Put([]byte(sessionID), sealed); err != nil {
+				return err
+			}
+		}
+		count = len(updates)
+		return nil
+	})
+
+	return count, err
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"go.etcd.io/bbolt"
+)
+
+const (
+	testKeyOld = "k1:old-secret-0123456789"
+	testKeyNew = "k2:new-secret-0123456789"
+)
+
+func newTestCipher(t *testing.T, spec string) *SessionCipher {
+	t.Helper()
+	c, err := NewSessionCipher(spec)
+	if err != nil {
+		t.Fatalf("NewSessionCipher(%q): %v", spec, err)
+	}
+	return c
+}
+
+func TestSessionCipherRoundTrip(t *testing.T) {
+	c := newTestCipher(t, testKeyNew+","+testKeyOld)
+	plaintext := []byte(`{"id":"abc","token":{"access_token":"secret-token"}}`)
+
+	sealed, err := c.Seal("abc", plaintext)
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+	if bytes.Contains(sealed, []byte("secret-token")) {
+		t.Fatalf("sealed value contains the plaintext token: %s", sealed)
+	}
+
+	opened, keyID, err := c.Open("abc", sealed)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if keyID != "k2" {
+		t.Errorf("sealed with key %q, want the first key k2", keyID)
+	}
+	if !bytes.Equal(opened, plaintext) {
+		t.Errorf("Open returned %s, want %s", opened, plaintext)
+	}
+}
+
+func TestSessionCipherBindsKeyAndSessionID(t *testing.T) {
+	c := newTestCipher(t, testKeyOld+","+testKeyNew)
+	sealed, err := c.Seal("abc", []byte(`{"id":"abc"}`))
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+
+	// Relabel the value as sealed by the other key the cipher knows
+	var relabeled sealedSession
+	if err := json.Unmarshal(sealed, &relabeled); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	relabeled.KeyID = "k2"
+	relabeledJSON, err := json.Marshal(relabeled)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	if _, _, err := c.Open("abc", relabeledJSON); err == nil {
+		t.Error("Open accepted a value relabeled with another key ID")
+	}
+
+	// The same key ID with a different secret can't unwrap it either
+	other := newTestCipher(t, "k1:another-secret-0123456789")
+	if _, _, err := other.Open("abc", sealed); err == nil {
+		t.Error("Open accepted a value sealed under a different secret")
+	}
+
+	// Nor can the value be moved to another session
+	if _, _, err := c.Open("xyz", sealed); err == nil {
+		t.Error("Open accepted a value sealed for another session ID")
+	}
+}
+
+func TestReencryptSessions(t *testing.T) {
+	db, err := bbolt.Open(filepath.Join(t.TempDir(), "sessions.db"), 0600, nil)
+	if err != nil {
+		t.Fatalf("bbolt.Open: %v", err)
+	}
+	defer db.Close()
+
+	oldCipher := newTestCipher(t, testKeyOld)
+	legacy := []byte(`{"id":"legacy","token":{"access_token":"legacy-token"}}`)
+	rotated := []byte(`{"id":"rotated","token":{"access_token":"rotated-token"}}`)
+	sealedOld, err := oldCipher.Seal("rotated", rotated)
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(SessionBucket))
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte("legacy"), legacy); err != nil {
+			return err
+		}
+		return b.Put([]byte("rotated"), sealedOld)
+	})
+	if err != nil {
+		t.Fatalf("seeding sessions: %v", err)
+	}
+
+	// Rotate: the new key goes first, the old one stays to decrypt
+	c := newTestCipher(t, testKeyNew+","+testKeyOld)
+	count, err := ReencryptSessions(db, c)
+	if err != nil {
+		t.Fatalf("ReencryptSessions: %v", err)
+	}
+	if count != 2 {
+		t.Errorf("re-encrypted %d sessions, want 2", count)
+	}
+
+	want := map[string][]byte{"legacy": legacy, "rotated": rotated}
+	err = db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(SessionBucket))
+		for sessionID, plaintext := range want {
+			opened, keyID, err := c.Open(sessionID, b.Get([]byte(sessionID)))
+			if err != nil {
+				t.Errorf("Open(%s): %v", sessionID, err)
+				continue
+			}
+			if keyID != "k2" {
+				t.Errorf("session %s is sealed with key %q, want k2", sessionID, keyID)
+			}
+			if !bytes.Equal(opened, plaintext) {
+				t.Errorf("session %s opened to %s, want %s", sessionID, opened, plaintext)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("View: %v", err)
+	}
+
+	// Everything is on the current key now, so a second pass has nothing to do
+	if count, err := ReencryptSessions(db, c); err != nil || count != 0 {
+		t.Errorf("second ReencryptSessions = %d, %v, want 0, nil", count, err)
+	}
+}
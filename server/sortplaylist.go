@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+
+	"spotify-vis/spotify"
+)
+
+const (
+	// grayThreshold is the HSV saturation below which a color has no meaningful hue
+	grayThreshold = 0.12
+	// rainbowBands is how many hue bands the rainbow sort splits the wheel into
+	rainbowBands = 12
+)
+
+// ColorSortModes are the orders SortTracksByColor can put tracks in
+var ColorSortModes = []string{"hue", "rainbow", "lightness"}
+
+// colorSortKey is what tracks are compared by, field by field
+type colorSortKey struct {
+	// unavailable albums have no real color, so they go after everything else
+	unavailable bool
+	gray        bool
+	band        float64
+	lightness   float64
+}
+
+// newColorSortKey builds the sort key of one color for mode. Grays sort after every
+// hue in the hue and rainbow modes, ordered light to dark.
+func newColorSortKey(c Color, mode string) colorSortKey {
+	hsv := c.ToHSV()
+	lightness := c.ToOKLab().L
+
+	switch mode {
+	case "lightness":
+		return colorSortKey{lightness: lightness}
+	case "rainbow":
+		// Within each band of the wheel go from light to dark, so the playlist moves
+		// through the colors as a few smooth gradients
+		band := math.Floor(hsv.H / (360.0 / rainbowBands))
+		return colorSortKey{gray: hsv.S < grayThreshold, band: band, lightness: -lightness}
+	default:
+		return colorSortKey{gray: hsv.S < grayThreshold, band: hsv.H, lightness: -lightness}
+	}
+}
+
+func (a colorSortKey) less(b colorSortKey) bool {
+	if a.unavailable != b.unavailable {
+		return !a.unavailable
+	}
+	if a.gray != b.gray {
+		return !a.gray
+	}
+	if !a.gray && a.band != b.band {
+		return a.band < b.band
+	}
+	return a.lightness < b.lightness
+}
+
+// SortTracksByColor orders tracks by their album's color from albumColors, using the
+// average or common color per colorMode. Tracks keep their relative order on ties,
+// tracks whose cover couldn't be loaded go last and tracks without colors are dropped.
+func SortTracksByColor(tracks []spotify.Track, albumColors map[string]ProcessedItem, mode string, colorMode string) []spotify.Track {
+	sorted := []spotify.Track{}
+	keys := map[string]colorSortKey{}
+	for _, track := range tracks {
+		item, ok := albumColors[track.Album.ID]
+		if !ok {
+			continue
+		}
+		if _, ok := keys[track.Album.ID]; !ok {
+			color := item.AvgColor
+			if colorMode == "common" {
+				color = item.CommonColor
+			}
+			key := newColorSortKey(color, mode)
+			key.unavailable = item.Unavailable
+			keys[track.Album.ID] = key
+		}
+		sorted = append(sorted, track)
+	}
+
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return keys[sorted[i].Album.ID].less(keys[sorted[j].Album.ID])
+	})
+
+	return sorted
+}
+
+// IncompletePlaylistError is returned when the sorted copy was created but not every
+// track could be added, and removing the copy again failed too
+type IncompletePlaylistError struct {
+	Playlist *spotify.Playlist
+	Err      error
+}
+
+func (e *IncompletePlaylistError) Error() string {
+	return fmt.Sprintf("playlist %s was created but not filled: %v", e.Playlist.ID, e.Err)
+}
+
+func (e *IncompletePlaylistError) Unwrap() error {
+	return e.Err
+}
+
+// errNoAddableTracks means none of the source's tracks can be added through the API,
+// e.g. a playlist of only local files
+var errNoAddableTracks = errors.New("no tracks that can be added to a playlist")
+
+// sourcePlaylistError marks a failure to read the playlist being copied, as opposed
+// to creating or filling the new one
+type sourcePlaylistError struct {
+	err error
+}
+
+func (e *sourcePlaylistError) Error() string {
+	return fmt.Sprintf("error reading source playlist: %v", e.err)
+}
+
+func (e *sourcePlaylistError) Unwrap() error {
+	return e.err
+}
+
+// CreateSortedPlaylist copies a playlist into a new playlist owned by the current
+// user, with the tracks sorted by color. An empty name is derived from the source's.
+func CreateSortedPlaylist(ctx context.Context, accessToken string, playlistID string, mode string, colorMode string, name string, public bool) (*spotify.Playlist, error) {
+	source, err := spotifyClient.Playlist(ctx, accessToken, playlistID)
+	if err != nil {
+		return nil, &sourcePlaylistError{err: err}
+	}
+	user, err := spotifyClient.CurrentUser(ctx, accessToken)
+	if err != nil {
+		return nil, err
+	}
+
+	tracks, err := GetPlaylistTrackList(ctx, playlistID, accessToken)
+	if err != nil {
+		return nil, &sourcePlaylistError{err: err}
+	}
+
+	processedItems := HandoffItemsForImageProcessing(ctx, UniqueAlbumTracks(tracks))
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	albumColors := make(map[string]ProcessedItem, len(processedItems))
+	for _, item := range processedItems {
+		albumColors[item.Track.Album.ID] = item
+	}
+
+	// Local files can't be added through the API, so only tracks with a Spotify URI make it
+	uris := []string{}
+	for _, track := range SortTracksByColor(tracks, albumColors, mode, colorMode) {
+		if strings.HasPrefix(track.URI, "spotify:track:") {
+			uris = append(uris, track.URI)
+		}
+	}
+
+	// Don't create a playlist that would stay empty
+	if len(uris) == 0 {
+		return nil, errNoAddableTracks
+	}
+
+	if name == "" {
+		name = fmt.Sprintf("%s (sorted by %s)", source.Name, mode)
+	}
+	description := fmt.Sprintf("%s, sorted by %s", source.Name, mode)
+	playlist, err := spotifyClient.CreatePlaylist(ctx, accessToken, user.ID, name, description, public)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshotID, err := spotifyClient.AddPlaylistItems(ctx, accessToken, playlist.ID, uris)
+	if err != nil {
+		// Don't leave an empty or half filled playlist behind. The request may already be
+		// cancelled, so the cleanup gets its own deadline.
+		cleanupCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), spotify.DefaultTimeout)
+		defer cancel()
+		if unfollowErr := spotifyClient.UnfollowPlaylist(cleanupCtx, accessToken, playlist.ID); unfollowErr != nil {
+			loggerFrom(ctx).Error("Error removing unfilled playlist", "playlist", playlist.ID, "err", unfollowErr)
+			return nil, &IncompletePlaylistError{Playlist: playlist, Err: err}
+		}
+		return nil, fmt.Errorf("error adding tracks to playlist %s, removed it again: %w", playlist.ID, err)
+	}
+	if snapshotID != "" {
+		playlist.SnapshotID = snapshotID
+	}
+	playlist.Tracks.Total = len(uris)
+
+	return playlist, nil
+}
+
+// Handler for POST /playlist/{playlistId}/sorted?sort=hue|rainbow|lightness&color=avg|common&name=&public=true.
+// Creates a color-sorted copy of the playlist in the user's account and responds with it.
+func playlistSorted(w http.ResponseWriter, r *http.Request, playlistID string) {
+	loggerFrom(r.Context()).Debug("Running handler", "handler", "/playlist/{playlistId}/sorted")
+
+	if r.Method != "POST" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte(`{"error": "Use POST to create a sorted playlist"}`))
+		return
+	}
+
+	query := r.URL.Query()
+	mode := query.Get("sort")
+	if mode == "" {
+		mode = "hue"
+	}
+	if !slices.Contains(ColorSortModes, mode) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": "sort must be hue, rainbow or lightness"}`))
+		return
+	}
+	colorMode := query.Get("color")
+	if colorMode == "" {
+		colorMode = "avg"
+	}
+	if colorMode != "avg" && colorMode != "common" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": "color must be avg or common"}`))
+		return
+	}
+
+	// Writing needs the user's own token, the app token can't own playlists
+	session, ok := requireSession(w, r)
+	if !ok {
+		return
+	}
+
+	playlist, err := CreateSortedPlaylist(r.Context(), session.Token.AccessToken, playlistID, mode, colorMode, query.Get("name"), query.Get("public") == "true")
+	if err != nil {
+		writeSortedPlaylistError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(playlist)
+}
+
+// writeSortedPlaylistError reports a failed sorted copy. Only failures reading the
+// source playlist are reported as not found, and a copy that was left behind unfilled
+// is returned so the client can point the user at it.
+func writeSortedPlaylistError(w http.ResponseWriter, r *http.Request, err error) {
+	loggerFrom(r.Context()).Error("Error creating sorted playlist", "err", err)
+	w.Header().Set("Content-Type", "application/json")
+
+	var incomplete *IncompletePlaylistError
+	var source *sourcePlaylistError
+	status := spotifyStatus(err)
+	switch {
+	case errors.As(err, &incomplete):
+		w.WriteHeader(http.StatusBadGateway)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error":      "Created the playlist but couldn't add its tracks",
+			"playlistId": incomplete.Playlist.ID,
+		})
+	case errors.Is(err, errNoAddableTracks):
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(`{"error": "The playlist has no tracks that can be copied"}`))
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"error": "Not allowed to create playlists, try logging in again"}`))
+	case errors.As(err, &source) && (status == http.StatusNotFound || status == http.StatusBadRequest):
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error": "Playlist not found or not public"}`))
+	case status == http.StatusTooManyRequests:
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"error": "Spotify is rate limiting requests, try again later"}`))
+	case status != 0:
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte(`{"error": "Spotify couldn't create the sorted playlist"}`))
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error": "Failed to create sorted playlist"}`))
+	}
+}
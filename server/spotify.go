@@ -1,157 +1,186 @@
 package main
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
+
+	"spotify-vis/spotify"
 )
 
-const (
-	SPOTIFY_API_BASE = "https://api.spotify.com/v1"
+// DefaultPageConcurrency is how many pages of one collection are fetched at once
+const DefaultPageConcurrency = 8
+
+var (
+	// spotifyClient is shared by every request to the Spotify Web API
+	spotifyClient = spotify.NewClient(nil)
+	// pageConcurrency bounds parallel page requests per collection
+	pageConcurrency = DefaultPageConcurrency
 )
 
-// Image represents a Spotify album image with dimensions
-type SpotifyImage struct {
-	URL    string `json:"url"`
-	Height int    `json:"height"`
-	Width  int    `json:"width"`
+// configureSpotifyClient applies SPOTIFY_API_BASE, SPOTIFY_RATE_LIMIT, SPOTIFY_RATE_BURST,
+// SPOTIFY_MAX_RETRIES and SPOTIFY_PAGE_CONCURRENCY to spotifyClient
+func configureSpotifyClient() error {
+	// Point the Spotify client at a stand-in API when one is configured
+	if base := os.Getenv("SPOTIFY_API_BASE"); base != "" {
+		spotifyClient.BaseURL = base
+	}
+
+	rate := float64(spotify.DefaultRateLimit)
+	if raw := os.Getenv("SPOTIFY_RATE_LIMIT"); raw != "" {
+		parsed, err := strconv.ParseFloat(raw, 64)
+		if err != nil || parsed <= 0 {
+			return fmt.Errorf("invalid SPOTIFY_RATE_LIMIT: %q", raw)
+		}
+		rate = parsed
+	}
+
+	burst := spotify.DefaultRateBurst
+	if raw := os.Getenv("SPOTIFY_RATE_BURST"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed <= 0 {
+			return fmt.Errorf("invalid SPOTIFY_RATE_BURST: %q", raw)
+		}
+		burst = parsed
+	}
+	spotifyClient.Limiter = spotify.NewRateLimiter(rate, burst)
+
+	if raw := os.Getenv("SPOTIFY_MAX_RETRIES"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed < 0 {
+			return fmt.Errorf("invalid SPOTIFY_MAX_RETRIES: %q", raw)
+		}
+		spotifyClient.MaxRetries = parsed
+	}
+
+	if raw := os.Getenv("SPOTIFY_PAGE_CONCURRENCY"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed <= 0 {
+			return fmt.Errorf("invalid SPOTIFY_PAGE_CONCURRENCY: %q", raw)
+		}
+		pageConcurrency = parsed
+	}
+
+	return nil
 }
+
+// Image represents a Spotify album image with dimensions
+type SpotifyImage = spotify.Image
+
 // TrackItem represents a track item in a Spotify playlist
 type TrackItem struct {
 	ID string `json:"id"`
 	Name string `json:"name"`
-	Album struct {
-		ID string `json:"id"`
-		Name string `json:"name"`
-		URL string `json:"href"`
-		Images []SpotifyImage `json:"images"`
-	} `json:"album"`
+	Album AlbumItem `json:"album"`
 }
-type jsonTrackItem struct {
-	Track TrackItem `json:"track"`
+// AlbumItem is the thinned down album sent along with each TrackItem
+type AlbumItem struct {
+	ID string `json:"id"`
+	Name string `json:"name"`
+	URL string `json:"href"`
+	Images []SpotifyImage `json:"images"`
 }
 type ProcessedItem struct {
 	Track TrackItem `json:"track"`
 	AvgColor Color `json:"avgColor"`
 	CommonColor Color `json:"commonColor"`
+	Palette []PaletteColor `json:"palette"`
+	AvgHSV HSV `json:"avgHsv"`
+	CommonHSV HSV `json:"commonHsv"`
+	// Unavailable is set when the cover couldn't be loaded, the colors are then meaningless
+	Unavailable bool `json:"unavailable,omitempty"`
 }
 
-// GetUserProfile fetches the current user's Spotify profile
-func GetUserProfile(accessToken string) ([]byte, error) {
-	// Create request to Spotify API
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s/me", SPOTIFY_API_BASE), nil)
-	if err != nil {
-		return nil, fmt.Errorf("error creating request: %v", err)
+// NewTrackItem thins a Spotify track down to what the visualizer needs
+func NewTrackItem(track spotify.Track) TrackItem {
+	return TrackItem{
+		ID:   track.ID,
+		Name: track.Name,
+		Album: AlbumItem{
+			ID:     track.Album.ID,
+			Name:   track.Album.Name,
+			URL:    track.Album.Href,
+			Images: track.Album.Images,
+		},
+	}
+}
+
+// NewProcessedItem bundles a track with its colors, precomputing the HSV values clients position by
+func NewProcessedItem(track TrackItem, avgColor Color, commonColor Color, palette []PaletteColor) ProcessedItem {
+	return ProcessedItem{
+		Track:       track,
+		AvgColor:    avgColor,
+		CommonColor: commonColor,
+		Palette:     palette,
+		AvgHSV:      avgColor.ToHSV(),
+		CommonHSV:   commonColor.ToHSV(),
 	}
+}
 
-	// Add authorization header
-	req.Header.Add("Authorization", "Bearer "+accessToken)
+// NewUnavailableItem is a track whose cover couldn't be loaded, sent without colors
+func NewUnavailableItem(track TrackItem) ProcessedItem {
+	return ProcessedItem{Track: track, Palette: []PaletteColor{}, Unavailable: true}
+}
 
-	// Make the request
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("error making request to Spotify API: %v", err)
+// AvailableItems drops the items whose colors couldn't be computed
+func AvailableItems(items []ProcessedItem) []ProcessedItem {
+	available := make([]ProcessedItem, 0, len(items))
+	for _, item := range items {
+		if !item.Unavailable {
+			available = append(available, item)
+		}
 	}
-	defer resp.Body.Close()
+	return available
+}
 
-	// Check response status
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("Spotify API returned non-200 status: %d", resp.StatusCode)
+// GetUserProfile fetches the current user's Spotify profile
+func GetUserProfile(ctx context.Context, accessToken string) ([]byte, error) {
+	user, err := spotifyClient.CurrentUser(ctx, accessToken)
+	if err != nil {
+		return nil, err
 	}
 
-	// Read response body
-	body, err := io.ReadAll(resp.Body)
+	body, err := json.Marshal(user)
 	if err != nil {
-		return nil, fmt.Errorf("error reading response body: %v", err)
+		return nil, fmt.Errorf("error marshaling user profile: %v", err)
 	}
 
 	return body, nil
 }
 
 // GetCurrentUserPlaylists fetches all playlists for the current user, handling pagination
-func GetCurrentUserPlaylists(accessToken string) ([]byte, error) {
+func GetCurrentUserPlaylists(ctx context.Context, accessToken string) ([]byte, error) {
 	start := time.Now()
 
 	// Define our playlist collection that will hold all playlists
 	type CombinedPlaylistsResponse struct {
-		Items []json.RawMessage `json:"items"`
-		Total int               `json:"total"`
+		Items []spotify.Playlist `json:"items"`
+		Total int                `json:"total"`
 	}
 
-	var allPlaylists CombinedPlaylistsResponse
-
-	// Start with the base endpoint
-	nextURL := fmt.Sprintf("%s/me/playlists?limit=50", SPOTIFY_API_BASE)
-
-	// Loop until we have no more pages to fetch
-	for nextURL != "" {
-		// Create request to Spotify API
-		req, err := http.NewRequest("GET", nextURL, nil)
-		if err != nil {
-			return nil, fmt.Errorf("error creating request: %v", err)
-		}
-
-		// Add authorization header
-		req.Header.Add("Authorization", "Bearer "+accessToken)
-
-		// Make the request
-		resp, err := http.DefaultClient.Do(req)
-		if err != nil {
-			return nil, fmt.Errorf("error making request to Spotify API: %v", err)
-		}
-
-		// Check response status
-		if resp.StatusCode != http.StatusOK {
-			resp.Body.Close()
-			return nil, fmt.Errorf("Spotify API returned non-200 status: %d", resp.StatusCode)
-		}
-
-		// Read response body
-		body, err := io.ReadAll(resp.Body)
-		resp.Body.Close()
-		if err != nil {
-			return nil, fmt.Errorf("error reading response body: %v", err)
-		}
-
-		// Parse the paginated response
-		var pageResponse PaginatedResponse
-		if err := json.Unmarshal(body, &pageResponse); err != nil {
-			return nil, fmt.Errorf("error parsing response JSON: %v", err)
-		}
-
-		// Set the total count on first page
-		if allPlaylists.Total == 0 {
-			allPlaylists.Total = pageResponse.Total
-		}
-
-		// Parse the items from this page
-		var items []json.RawMessage
-		if err := json.Unmarshal(pageResponse.Items, &items); err != nil {
-			// If items is not an array, it might be a single item
-			items = []json.RawMessage{pageResponse.Items}
-		}
-
-		// Add these items to our collection
-		allPlaylists.Items = append(allPlaylists.Items, items...)
-
-		// Update the URL for the next page, or set to empty string to end the loop
-		nextURL = pageResponse.Next
+	firstPage, err := spotifyClient.CurrentUserPlaylists(ctx, accessToken, 0, 50)
+	if err != nil {
+		return nil, err
+	}
 
-		fmt.Printf("Fetched playlists page, items: %d, next URL: %s\n", len(items), nextURL)
+	playlists, err := spotify.AllPages(ctx, spotifyClient, accessToken, firstPage)
+	if err != nil {
+		return nil, err
 	}
 
-	fmt.Printf("Total playlists collected: %d\n", len(allPlaylists.Items))
-	fmt.Printf("Time to collect all playlists: %s\n", time.Since(start))
+	loggerFrom(ctx).Debug("Collected playlists", "count", len(playlists), "elapsed", time.Since(start))
 
 	// Marshal the combined playlists back to JSON
-	result, err := json.Marshal(allPlaylists)
+	result, err := json.Marshal(CombinedPlaylistsResponse{Items: playlists, Total: firstPage.Total})
 	if err != nil {
 		return nil, fmt.Errorf("error marshaling combined playlist list: %v", err)
 	}
@@ -159,123 +188,121 @@ func GetCurrentUserPlaylists(accessToken string) ([]byte, error) {
 	return result, nil
 }
 
-// PaginatedResponse is a generic structure for Spotify's paginated responses
-type PaginatedResponse struct {
-	Next  string          `json:"next"`
-	Items json.RawMessage `json:"items"`
-	Total int             `json:"total"`
+// GetPlaylistTracks fetches and processes all tracks for a specific playlist as JSON
+func GetPlaylistTracks(ctx context.Context, playlistId string, accessToken string) ([]byte, error) {
+	processedItems, err := GetPlaylistItems(ctx, playlistId, accessToken)
+	if err != nil {
+		return nil, err
+	}
+
+	// Marshal the combined tracks back to JSON
+	result, err := json.Marshal(processedItems)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling processed track list: %v", err)
+	}
+
+	return result, nil
 }
 
-// GetPlaylistTracks fetches all tracks for a specific playlist, handling pagination
-func GetPlaylistTracks(playlistId string, accessToken string) ([]byte, error) {
+// GetPlaylistItems fetches all tracks for a specific playlist, handling pagination,
+// and returns one processed item per unique album
+func GetPlaylistItems(ctx context.Context, playlistId string, accessToken string) ([]ProcessedItem, error) {
 	start := time.Now()
 
-	// Define our track collection that will hold all tracks
-	type CombinedTracksResponse struct {
-		Items []json.RawMessage `json:"items"`
-		Total int               `json:"total"`
+	trackItems, err := GetPlaylistAlbumTracks(ctx, playlistId, accessToken)
+	if err != nil {
+		return nil, err
 	}
 
-	var allTracks CombinedTracksResponse
-
-	// Start with the base endpoint
-	nextURL := fmt.Sprintf("%s/playlists/%s/tracks", SPOTIFY_API_BASE, playlistId)
+	// Process the images
+	loggerFrom(ctx).Debug("Starting image processing", "albums", len(trackItems))
+	processedItems := HandoffItemsForImageProcessing(ctx, trackItems)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	loggerFrom(ctx).Debug("Processed tracks", "count", len(processedItems), "elapsed", time.Since(start))
 
-	// Loop until we have no more pages to fetch
-	for nextURL != "" {
-		// Create request to Spotify API
-		req, err := http.NewRequest("GET", nextURL, nil)
-		if err != nil {
-			return nil, fmt.Errorf("error creating request: %v", err)
-		}
-		fmt.Printf("  Time to create request: %s\n", time.Since(start))
+	return processedItems, nil
+}
 
-		// Add authorization header
-		req.Header.Add("Authorization", "Bearer "+accessToken)
+// GetPlaylistAlbumTracks fetches all tracks for a specific playlist, handling pagination,
+// and returns the first track seen for each unique album
+func GetPlaylistAlbumTracks(ctx context.Context, playlistId string, accessToken string) ([]TrackItem, error) {
+	tracks, err := GetPlaylistTrackList(ctx, playlistId, accessToken)
+	if err != nil {
+		return nil, err
+	}
 
-		// Make the request
-		resp, err := http.DefaultClient.Do(req)
-		if err != nil {
-			return nil, fmt.Errorf("error making request to Spotify API: %v", err)
-		}
-		fmt.Printf("  Time to receive request: %s\n", time.Since(start))
+	return UniqueAlbumTracks(tracks), nil
+}
 
-		// Check response status
-		if resp.StatusCode != http.StatusOK {
-			resp.Body.Close()
-			return nil, fmt.Errorf("Spotify API returned non-200 status: %d", resp.StatusCode)
-		}
+// GetPlaylistTrackList fetches every track of a playlist in order, with only the
+// fields in spotify.PlaylistTrackAlbumFields filled in
+func GetPlaylistTrackList(ctx context.Context, playlistId string, accessToken string) ([]spotify.Track, error) {
+	start := time.Now()
 
-		// Read response body
-		body, err := io.ReadAll(resp.Body)
-		resp.Body.Close()
-		if err != nil {
-			return nil, fmt.Errorf("error reading response body: %v", err)
-		}
+	// Only the album fields are requested, which keeps the pages small
+	firstPage, err := spotifyClient.PlaylistTrackAlbums(ctx, accessToken, playlistId, 0, 100)
+	if err != nil {
+		return nil, err
+	}
 
-		// Parse the paginated response
-		var pageResponse PaginatedResponse
-		if err := json.Unmarshal(body, &pageResponse); err != nil {
-			return nil, fmt.Errorf("error parsing response JSON: %v", err)
-		}
+	// The first page gives the total, so every other page can be requested at once
+	fetchPage := func(ctx context.Context, offset int, limit int) (*spotify.Paging[spotify.ThinPlaylistTrack], error) {
+		return spotifyClient.PlaylistTrackAlbums(ctx, accessToken, playlistId, offset, limit)
+	}
+	entries, err := spotify.AllPagesConcurrent(ctx, firstPage, fetchPage, pageConcurrency)
+	if err != nil {
+		return nil, err
+	}
 
-		// Set the total count on first page
-		if allTracks.Total == 0 {
-			allTracks.Total = pageResponse.Total
-		}
+	loggerFrom(ctx).Debug("Collected tracks", "count", len(entries), "elapsed", time.Since(start))
 
-		// Parse the items from this page
-		var items []json.RawMessage
-		if err := json.Unmarshal(pageResponse.Items, &items); err != nil {
-			// If items is not an array, it might be a single item
-			items = []json.RawMessage{pageResponse.Items}
+	// Removed tracks come back as null
+	tracks := make([]spotify.Track, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Track != nil {
+			tracks = append(tracks, entry.Track.ToTrack())
 		}
-
-		// Add these items to our collection
-		allTracks.Items = append(allTracks.Items, items...)
-
-		// Update the URL for the next page, or set to empty string to end the loop
-		nextURL = pageResponse.Next
-
-		fmt.Printf("Fetched playlist tracks page, items: %d, next URL: %s\n", len(items), nextURL)
 	}
 
-	fmt.Printf("Total tracks collected: %d\n", len(allTracks.Items))
-	fmt.Printf("  Time to collect tracks: %s\n", time.Since(start))
+	return tracks, nil
+}
 
-	// Parse all tracks into TrackItem structs
+// UniqueAlbumTracks keeps the first track seen for each album, skipping local tracks without one
+func UniqueAlbumTracks(tracks []spotify.Track) []TrackItem {
 	trackItems := []TrackItem{}
 	albumSet := make(map[string]bool)
-	for _, item := range allTracks.Items {
-		var trackItem jsonTrackItem
-		if err := json.Unmarshal(item, &trackItem); err != nil {
-			return nil, fmt.Errorf("error parsing track item: %v", err)
+	for _, track := range tracks {
+		if track.Album.ID == "" {
+			continue
 		}
-		if _, ok := albumSet[trackItem.Track.Album.ID]; !ok {
-			trackItems = append(trackItems, trackItem.Track)
-			albumSet[trackItem.Track.Album.ID] = true
+		if _, ok := albumSet[track.Album.ID]; !ok {
+			trackItems = append(trackItems, NewTrackItem(track))
+			albumSet[track.Album.ID] = true
 		}
 	}
-	fmt.Println("Total unique albums: ", len(albumSet))
-
-	// Process the images
-	fmt.Printf("Starting image processing: %s\n", time.Now())
-	processedItems := HandoffItemsForImageProcessing(trackItems)
-	fmt.Printf("Processed %d tracks\n", len(processedItems))
-	fmt.Printf("  Time to process images: %s\n", time.Since(start))
-
-	// Marshal the combined tracks back to JSON
-	result, err := json.Marshal(processedItems)
-	if err != nil {
-		return nil, fmt.Errorf("error marshaling processed track list: %v", err)
-	}
+	slog.Debug("Found unique albums", "count", len(albumSet))
 
-	return result, nil
+	return trackItems
 }
 
-func HandoffItemsForImageProcessing(items []TrackItem) []ProcessedItem {
+func HandoffItemsForImageProcessing(ctx context.Context, items []TrackItem) []ProcessedItem {
 	processedItems := make([]ProcessedItem, len(items))
 
+	ProcessItems(ctx, items, func(i int, item ProcessedItem, cached bool) {
+		processedItems[i] = item
+	})
+
+	return processedItems
+}
+
+// ProcessItems computes (or looks up) the colors for every item and hands each result to
+// onReady as soon as it is available. Cache hits are delivered first, from the calling
+// goroutine, and the rest are delivered concurrently as their covers are processed, so
+// onReady must be safe to call from multiple goroutines. Returns once every item is done,
+// or as soon as ctx is cancelled, in which case the remaining items are skipped.
+func ProcessItems(ctx context.Context, items []TrackItem, onReady func(i int, item ProcessedItem, cached bool)) {
 	// Pull the album ids
 	albumIds := make([]string, len(items))
 	for i, item := range items {
@@ -285,60 +312,117 @@ func HandoffItemsForImageProcessing(items []TrackItem) []ProcessedItem {
 	// Check cache
 	cacheHits, err := GetCache(albumIds)
 	if err != nil {
-		fmt.Println("Error getting cache entries:", err)
+		loggerFrom(ctx).Error("Error getting cache entries", "err", err)
+		cacheHits = make([]*CacheEntry, len(items))
 	}
 
-	var wg sync.WaitGroup
-	wg.Add(len(items))
-	cacheUpdates := make([]CacheUpdate, len(items))
-
+	// Deliver everything the cache already knows before any downloads start
+	misses := []int{}
 	for i, item := range items {
-		go func(i int, item TrackItem) {
-			defer wg.Done()
+		// Check cache hits (nil pointer means nothing came back from Redis for the key)
+		if cacheHits[i] == nil {
+			misses = append(misses, i)
+			continue
+		}
+		avgColor, commonColor, palette := cacheHits[i].Colors()
 
-			var avgColor Color
-			var commonColor Color
+		// Serve colors from an older extractor now, but refresh them for next time
+		if cacheHits[i].Version < ColorAlgorithmVersion {
+			QueueRecompute(item.Album.ID, FindSmallestImage(&item.Album.Images))
+		}
 
-			// Check cache hits (nil pointer means nothing came back from Redis for the key)
-			if cacheHits[i] != nil {
-				avgColor = HexToColor((*cacheHits[i]).AvgColor)
-				commonColor = HexToColor((*cacheHits[i]).CommonColor)
-			} else {
-				smallestImage := FindSmallestImage(&item.Album.Images)
-				avgColor, commonColor = ProcessImage(smallestImage)
+		onReady(i, NewProcessedItem(item, avgColor, commonColor, palette), true)
+	}
 
-				// Add values to map of cache updates
-				cacheUpdates[i] = CacheUpdate{
-					AlbumID: item.Album.ID,
-					Value: CacheEntry{
-						AvgColor:    avgColor.ToHex(),
-						CommonColor: commonColor.ToHex(),
-					},
-				}
-			}
+	cacheUpdates := make([]CacheUpdate, len(misses))
 
-			processedItems[i] = ProcessedItem{Track: item, AvgColor: avgColor, CommonColor: commonColor}
-		}(i, item)
-	}
+	// Downloads share a bounded pool so big playlists can't open thousands of sockets
+	imagePool.Run(ctx, len(misses), func(j int) {
+		i := misses[j]
+		item := items[i]
 
-	// Wait for all goroutines to finish
-	wg.Wait()
+		smallestImage := FindSmallestImage(&item.Album.Images)
+		avgColor, commonColor, palette, err := ProcessImage(ctx, smallestImage)
 
-	// Apply the map of cache updates
-	go SetCache(cacheUpdates)
+		// A cancelled download isn't a real result, so don't cache or deliver it
+		if ctx.Err() != nil {
+			return
+		}
 
-	return processedItems
+		// Nor is a cover that failed to load, but the client still hears about the track.
+		// Leaving it uncached means the next request tries again.
+		if err != nil {
+			loggerFrom(ctx).Warn("Error processing cover", "album_id", item.Album.ID, "err", err)
+			onReady(i, NewUnavailableItem(item), false)
+			return
+		}
+
+		// Add values to map of cache updates
+		cacheUpdates[j] = CacheUpdate{
+			AlbumID: item.Album.ID,
+			Value:   NewCacheEntry(avgColor, commonColor, palette),
+		}
+
+		onReady(i, NewProcessedItem(item, avgColor, commonColor, palette), false)
+	})
+
+	// Apply the map of cache updates
+	cacheWrites.Add(1)
+	go func() {
+		defer cacheWrites.Done()
+		if err := SetCache(cacheUpdates); err != nil {
+			loggerFrom(ctx).Error("Error setting cache entries", "err", err)
+		}
+	}()
 }
 
 // RefreshAccessToken refreshes an access token using a refresh token
 func RefreshAccessToken(refreshToken string) (SpotifyTokenResponse, error) {
-	tokenUrl := "https://accounts.spotify.com/api/token"
-
 	// Prepare the form data
 	formData := url.Values{}
 	formData.Set("grant_type", "refresh_token")
 	formData.Set("refresh_token", refreshToken)
 
+	return requestToken(formData)
+}
+
+// ExchangeAuthorizationCode trades the code from the login callback for a user token.
+// codeVerifier is the PKCE verifier of the login attempt, or empty without PKCE.
+func ExchangeAuthorizationCode(code string, codeVerifier string) (SpotifyTokenResponse, error) {
+	formData := url.Values{}
+	formData.Set("grant_type", "authorization_code")
+	formData.Set("code", code)
+	formData.Set("redirect_uri", os.Getenv("REDIRECT_URI"))
+	if codeVerifier != "" {
+		formData.Set("code_verifier", codeVerifier)
+	}
+
+	return requestToken(formData)
+}
+
+// RequestClientCredentialsToken gets an app token that isn't tied to any user, which
+// can read public data such as public playlists
+func RequestClientCredentialsToken() (SpotifyTokenResponse, error) {
+	formData := url.Values{}
+	formData.Set("grant_type", "client_credentials")
+
+	return requestToken(formData)
+}
+
+// tokenClient bounds calls to the accounts service so a hung request can't stall logins
+// or the token refreshers
+var tokenClient = &http.Client{Timeout: spotify.DefaultTimeout}
+
+// requestToken posts formData to the accounts token endpoint with the app's credentials.
+// Without a client secret the app is a public PKCE client and only sends its ID.
+func requestToken(formData url.Values) (SpotifyTokenResponse, error) {
+	tokenUrl := "https://accounts.spotify.com/api/token"
+
+	clientSecret := os.Getenv("SPOTIFY_CLIENT_SECRET")
+	if clientSecret == "" {
+		formData.Set("client_id", os.Getenv("SPOTIFY_CLIENT_ID"))
+	}
+
 	// Create the request
 	req, err := http.NewRequest("POST", tokenUrl, strings.NewReader(formData.Encode()))
 	if err != nil {
@@ -347,13 +431,14 @@ func RefreshAccessToken(refreshToken string) (SpotifyTokenResponse, error) {
 
 	// Set headers
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	authString := fmt.Sprintf("%s:%s", os.Getenv("SPOTIFY_CLIENT_ID"), os.Getenv("SPOTIFY_CLIENT_SECRET"))
-	encodedAuth := base64.StdEncoding.EncodeToString([]byte(authString))
-	req.Header.Set("Authorization", fmt.Sprintf("Basic %s", encodedAuth))
+	if clientSecret != "" {
+		authString := fmt.Sprintf("%s:%s", os.Getenv("SPOTIFY_CLIENT_ID"), clientSecret)
+		encodedAuth := base64.StdEncoding.EncodeToString([]byte(authString))
+		req.Header.Set("Authorization", fmt.Sprintf("Basic %s", encodedAuth))
+	}
 
 	// Make the request
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := tokenClient.Do(req)
 	if err != nil {
 		return SpotifyTokenResponse{}, fmt.Errorf("error making request: %v", err)
 	}
@@ -362,7 +447,7 @@ func RefreshAccessToken(refreshToken string) (SpotifyTokenResponse, error) {
 	// Check response status
 	if resp.StatusCode != http.StatusOK {
 		respBody, _ := io.ReadAll(resp.Body)
-		return SpotifyTokenResponse{}, fmt.Errorf("Spotify API returned non-200 status: %d, body: %s", resp.StatusCode, string(respBody))
+		return SpotifyTokenResponse{}, &spotify.Error{StatusCode: resp.StatusCode, Body: string(respBody)}
 	}
 
 	// Parse the response
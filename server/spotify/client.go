@@ -0,0 +1,225 @@
+// Package spotify is a small typed client for the parts of the Spotify Web API
+// the visualizer uses.
+package spotify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultBaseURL is the root of the Spotify Web API
+	DefaultBaseURL = "https://api.spotify.com/v1"
+	// DefaultTimeout bounds a single API request
+	DefaultTimeout = 15 * time.Second
+	// DefaultRateLimit is the average number of requests per second across the app
+	DefaultRateLimit = 10
+	// DefaultRateBurst is how many requests can go out at once after a quiet period
+	DefaultRateBurst = 20
+	// DefaultMaxRetries is how many times a throttled or failed request is retried
+	DefaultMaxRetries = 4
+	// defaultRetryAfter is used when a 429 comes back without a usable Retry-After header
+	defaultRetryAfter = 1 * time.Second
+	// maxRetryAfter is the longest Retry-After worth waiting out, longer ones fail right away
+	maxRetryAfter = 30 * time.Second
+	// baseBackoff is the first delay before retrying a 5xx, doubled on every attempt
+	baseBackoff = 500 * time.Millisecond
+	// maxBackoff caps the delay between 5xx retries
+	maxBackoff = 10 * time.Second
+)
+
+// Client makes authenticated requests against the Web API. BaseURL can point at a
+// local stand-in (such as an httptest.Server) instead of api.spotify.com.
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client
+	// Limiter paces every request, nil disables rate limiting
+	Limiter *RateLimiter
+	// MaxRetries bounds retries of 429 and 5xx responses
+	MaxRetries int
+}
+
+// NewClient creates a client for the real API using httpClient, or a client with
+// DefaultTimeout when httpClient is nil
+func NewClient(httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: DefaultTimeout}
+	}
+	return &Client{
+		BaseURL:    DefaultBaseURL,
+		HTTPClient: httpClient,
+		Limiter:    NewRateLimiter(DefaultRateLimit, DefaultRateBurst),
+		MaxRetries: DefaultMaxRetries,
+	}
+}
+
+// Error is returned when the API answers with a non-200 status
+type Error struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("Spotify API returned non-200 status: %d, body: %s", e.StatusCode, e.Body)
+}
+
+// URL resolves path against BaseURL. Absolute URLs (like a page's next link) are
+// rewritten onto BaseURL so paging keeps working against a stand-in server.
+func (c *Client) URL(path string) string {
+	if strings.HasPrefix(path, DefaultBaseURL) {
+		path = strings.TrimPrefix(path, DefaultBaseURL)
+	} else if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
+		return path
+	}
+	return strings.TrimRight(c.BaseURL, "/") + "/" + strings.TrimLeft(path, "/")
+}
+
+// GetRaw makes a GET request with the access token and returns the response body
+func (c *Client) GetRaw(ctx context.Context, accessToken string, path string) ([]byte, error) {
+	return c.Do(ctx, accessToken, "GET", path, nil)
+}
+
+// Get makes a GET request with the access token and decodes the JSON response into v
+func (c *Client) Get(ctx context.Context, accessToken string, path string, v interface{}) error {
+	body, err := c.GetRaw(ctx, accessToken, path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("error parsing response JSON: %v", err)
+	}
+	return nil
+}
+
+// Do makes a request with the access token, sending payload as JSON when it isn't nil,
+// and returns the response body. Any 2xx status counts as success. A 429 waits out its
+// Retry-After (pausing every other request too) unless it is longer than maxRetryAfter,
+// and a 5xx backs off exponentially with jitter, both up to MaxRetries times. A 5xx
+// doesn't say whether the write went through, so only idempotent methods retry it.
+func (c *Client) Do(ctx context.Context, accessToken string, method string, path string, payload interface{}) ([]byte, error) {
+	var data []byte
+	if payload != nil {
+		var err error
+		data, err = json.Marshal(payload)
+		if err != nil {
+			return nil, fmt.Errorf("error encoding request: %v", err)
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		if c.Limiter != nil {
+			if err := c.Limiter.Wait(ctx); err != nil {
+				return nil, err
+			}
+		}
+
+		status, header, body, err := c.send(ctx, accessToken, method, path, data)
+		if err != nil {
+			return nil, err
+		}
+		if status >= 200 && status <= 299 {
+			return body, nil
+		}
+
+		apiErr := &Error{StatusCode: status, Body: string(body)}
+		if attempt >= c.MaxRetries {
+			return nil, apiErr
+		}
+
+		var delay time.Duration
+		switch {
+		case status == http.StatusTooManyRequests:
+			delay = retryAfter(header)
+			// Holding every user's requests for minutes is worse than failing this one
+			if delay > maxRetryAfter {
+				return nil, apiErr
+			}
+			if c.Limiter != nil {
+				c.Limiter.PauseUntil(time.Now().Add(delay))
+			}
+		case status >= 500 && idempotent(method):
+			delay = backoff(attempt)
+		default:
+			return nil, apiErr
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// send makes a single request and returns the status, headers and body
+func (c *Client) send(ctx context.Context, accessToken string, method string, path string, data []byte) (int, http.Header, []byte, error) {
+	var reqBody io.Reader
+	if data != nil {
+		reqBody = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.URL(path), reqBody)
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("error creating request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	if data != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("error making request to Spotify API: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("error reading response body: %v", err)
+	}
+
+	return resp.StatusCode, resp.Header, body, nil
+}
+
+// idempotent reports whether repeating a request with method has the same effect as sending it once
+func idempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// retryAfter reads the delay Spotify asks for, in seconds or as an HTTP date
+func retryAfter(header http.Header) time.Duration {
+	raw := header.Get("Retry-After")
+	if seconds, err := strconv.Atoi(raw); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(raw); err == nil {
+		if delay := time.Until(at); delay > 0 {
+			return delay
+		}
+	}
+	return defaultRetryAfter
+}
+
+// backoff doubles the delay for every attempt and adds up to 50% jitter so that
+// concurrent requests don't all retry at the same moment
+func backoff(attempt int) time.Duration {
+	delay := baseBackoff << attempt
+	if delay > maxBackoff || delay <= 0 {
+		delay = maxBackoff
+	}
+	return delay + time.Duration(rand.Int63n(int64(delay)/2+1))
+}
@@ -0,0 +1,342 @@
+package spotify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sync"
+)
+
+// CurrentUser fetches the profile of the user the token belongs to
+func (c *Client) CurrentUser(ctx context.Context, accessToken string) (*User, error) {
+	var user User
+	if err := c.Get(ctx, accessToken, "/me", &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// CurrentUserPlaylists fetches one page of the current user's playlists
+func (c *Client) CurrentUserPlaylists(ctx context.Context, accessToken string, offset int, limit int) (*Paging[Playlist], error) {
+	var page Paging[Playlist]
+	path := fmt.Sprintf("/me/playlists?offset=%d&limit=%d", offset, limit)
+	if err := c.Get(ctx, accessToken, path, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// PlaylistTracks fetches one page of a playlist's tracks
+func (c *Client) PlaylistTracks(ctx context.Context, accessToken string, playlistID string, offset int, limit int) (*Paging[PlaylistTrack], error) {
+	var page Paging[PlaylistTrack]
+	path := fmt.Sprintf("/playlists/%s/tracks?offset=%d&limit=%d", url.PathEscape(playlistID), offset, limit)
+	if err := c.Get(ctx, accessToken, path, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// PlaylistTrackAlbums fetches one page of a playlist's tracks, thinned down with
+// PlaylistTrackAlbumFields to just each track's ID, name and album
+func (c *Client) PlaylistTrackAlbums(ctx context.Context, accessToken string, playlistID string, offset int, limit int) (*Paging[ThinPlaylistTrack], error) {
+	params := url.Values{}
+	params.Set("offset", fmt.Sprint(offset))
+	params.Set("limit", fmt.Sprint(limit))
+	params.Set("fields", PlaylistTrackAlbumFields)
+
+	var page Paging[ThinPlaylistTrack]
+	path := fmt.Sprintf("/playlists/%s/tracks?%s", url.PathEscape(playlistID), params.Encode())
+	if err := c.Get(ctx, accessToken, path, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// PlaylistFields limits a playlist lookup to its metadata, leaving out the first page of tracks
+const PlaylistFields = "id,name,description,public,collaborative,snapshot_id,images,owner(id,display_name,external_urls,uri),tracks(href,total),external_urls,uri"
+
+// Playlist fetches a playlist's metadata
+func (c *Client) Playlist(ctx context.Context, accessToken string, playlistID string) (*Playlist, error) {
+	params := url.Values{}
+	params.Set("fields", PlaylistFields)
+
+	var playlist Playlist
+	path := fmt.Sprintf("/playlists/%s?%s", url.PathEscape(playlistID), params.Encode())
+	if err := c.Get(ctx, accessToken, path, &playlist); err != nil {
+		return nil, err
+	}
+	return &playlist, nil
+}
+
+// SavedAlbums fetches one page of the albums in the current user's library
+func (c *Client) SavedAlbums(ctx context.Context, accessToken string, offset int, limit int) (*Paging[SavedAlbum], error) {
+	var page Paging[SavedAlbum]
+	path := fmt.Sprintf("/me/albums?offset=%d&limit=%d", offset, limit)
+	if err := c.Get(ctx, accessToken, path, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// SavedTracks fetches one page of the tracks in the current user's library
+func (c *Client) SavedTracks(ctx context.Context, accessToken string, offset int, limit int) (*Paging[SavedTrack], error) {
+	var page Paging[SavedTrack]
+	path := fmt.Sprintf("/me/tracks?offset=%d&limit=%d", offset, limit)
+	if err := c.Get(ctx, accessToken, path, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// ArtistAlbums fetches one page of an artist's albums and singles
+func (c *Client) ArtistAlbums(ctx context.Context, accessToken string, artistID string, offset int, limit int) (*Paging[Album], error) {
+	var page Paging[Album]
+	path := fmt.Sprintf("/artists/%s/albums?include_groups=album,single&offset=%d&limit=%d", url.PathEscape(artistID), offset, limit)
+	if err := c.Get(ctx, accessToken, path, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// Album fetches an album's metadata
+func (c *Client) Album(ctx context.Context, accessToken string, albumID string) (*Album, error) {
+	var album Album
+	if err := c.Get(ctx, accessToken, fmt.Sprintf("/albums/%s", url.PathEscape(albumID)), &album); err != nil {
+		return nil, err
+	}
+	return &album, nil
+}
+
+// AlbumTracks fetches one page of an album's tracks
+func (c *Client) AlbumTracks(ctx context.Context, accessToken string, albumID string, offset int, limit int) (*Paging[SimpleTrack], error) {
+	var page Paging[SimpleTrack]
+	path := fmt.Sprintf("/albums/%s/tracks?offset=%d&limit=%d", url.PathEscape(albumID), offset, limit)
+	if err := c.Get(ctx, accessToken, path, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// TimeRanges are the windows Spotify computes a user's top items over, roughly the
+// last 4 weeks, 6 months and year
+var TimeRanges = []string{"short_term", "medium_term", "long_term"}
+
+// TopTracks fetches one page of the current user's top tracks over timeRange
+func (c *Client) TopTracks(ctx context.Context, accessToken string, timeRange string, offset int, limit int) (*Paging[Track], error) {
+	var page Paging[Track]
+	path := fmt.Sprintf("/me/top/tracks?time_range=%s&offset=%d&limit=%d", url.QueryEscape(timeRange), offset, limit)
+	if err := c.Get(ctx, accessToken, path, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// TopArtists fetches one page of the current user's top artists over timeRange
+func (c *Client) TopArtists(ctx context.Context, accessToken string, timeRange string, offset int, limit int) (*Paging[Artist], error) {
+	var page Paging[Artist]
+	path := fmt.Sprintf("/me/top/artists?time_range=%s&offset=%d&limit=%d", url.QueryEscape(timeRange), offset, limit)
+	if err := c.Get(ctx, accessToken, path, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// RecentlyPlayed fetches the current user's most recent plays, newest first
+func (c *Client) RecentlyPlayed(ctx context.Context, accessToken string, limit int) (*CursorPaging[PlayHistory], error) {
+	var page CursorPaging[PlayHistory]
+	path := fmt.Sprintf("/me/player/recently-played?limit=%d", limit)
+	if err := c.Get(ctx, accessToken, path, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// AllCursorPages follows the next links from first for at most maxPages pages in
+// total and returns every item across them
+func AllCursorPages[T any](ctx context.Context, c *Client, accessToken string, first *CursorPaging[T], maxPages int) ([]T, error) {
+	items := append([]T{}, first.Items...)
+
+	next := first.Next
+	for pages := 1; next != "" && pages < maxPages; pages++ {
+		var page CursorPaging[T]
+		if err := c.Get(ctx, accessToken, next, &page); err != nil {
+			return nil, err
+		}
+		// An empty page means the history has run out, even if there is a next link
+		if len(page.Items) == 0 {
+			break
+		}
+		items = append(items, page.Items...)
+		next = page.Next
+	}
+
+	return items, nil
+}
+
+// CurrentlyPlaying fetches what the current user is playing, returning nil when the
+// player is idle
+func (c *Client) CurrentlyPlaying(ctx context.Context, accessToken string) (*CurrentlyPlaying, error) {
+	body, err := c.GetRaw(ctx, accessToken, "/me/player/currently-playing")
+	if err != nil {
+		return nil, err
+	}
+	// Spotify answers 204 with no body when nothing is playing
+	if len(body) == 0 {
+		return nil, nil
+	}
+
+	var playing CurrentlyPlaying
+	if err := json.Unmarshal(body, &playing); err != nil {
+		return nil, fmt.Errorf("error parsing response JSON: %v", err)
+	}
+	return &playing, nil
+}
+
+// CreatePlaylist creates an empty playlist owned by userID, who must be the user the token belongs to
+func (c *Client) CreatePlaylist(ctx context.Context, accessToken string, userID string, name string, description string, public bool) (*Playlist, error) {
+	payload := map[string]interface{}{
+		"name":        name,
+		"description": description,
+		"public":      public,
+	}
+	body, err := c.Do(ctx, accessToken, "POST", fmt.Sprintf("/users/%s/playlists", url.PathEscape(userID)), payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var playlist Playlist
+	if err := json.Unmarshal(body, &playlist); err != nil {
+		return nil, fmt.Errorf("error parsing response JSON: %v", err)
+	}
+	return &playlist, nil
+}
+
+// UnfollowPlaylist removes a playlist from the current user's library, which is how
+// Spotify deletes a playlist the user owns
+func (c *Client) UnfollowPlaylist(ctx context.Context, accessToken string, playlistID string) error {
+	_, err := c.Do(ctx, accessToken, "DELETE", fmt.Sprintf("/playlists/%s/followers", url.PathEscape(playlistID)), nil)
+	return err
+}
+
+// MaxPlaylistItemsPerRequest is the most URIs Spotify takes in one add-items request
+const MaxPlaylistItemsPerRequest = 100
+
+// AddPlaylistItems appends the track URIs to a playlist in order, split into as
+// many requests as needed, and returns the playlist's final snapshot ID
+func (c *Client) AddPlaylistItems(ctx context.Context, accessToken string, playlistID string, uris []string) (string, error) {
+	path := fmt.Sprintf("/playlists/%s/tracks", url.PathEscape(playlistID))
+
+	snapshotID := ""
+	for start := 0; start < len(uris); start += MaxPlaylistItemsPerRequest {
+		end := min(start+MaxPlaylistItemsPerRequest, len(uris))
+		body, err := c.Do(ctx, accessToken, "POST", path, map[string][]string{"uris": uris[start:end]})
+		if err != nil {
+			return "", err
+		}
+
+		var snapshot struct {
+			SnapshotID string `json:"snapshot_id"`
+		}
+		if err := json.Unmarshal(body, &snapshot); err != nil {
+			return "", fmt.Errorf("error parsing response JSON: %v", err)
+		}
+		snapshotID = snapshot.SnapshotID
+	}
+
+	return snapshotID, nil
+}
+
+// AllPages follows the next links from first and returns every item across all pages
+func AllPages[T any](ctx context.Context, c *Client, accessToken string, first *Paging[T]) ([]T, error) {
+	items := append([]T{}, first.Items...)
+
+	next := first.Next
+	for next != "" {
+		var page Paging[T]
+		if err := c.Get(ctx, accessToken, next, &page); err != nil {
+			return nil, err
+		}
+		items = append(items, page.Items...)
+		next = page.Next
+	}
+
+	return items, nil
+}
+
+// PageFetcher fetches the page of a collection starting at offset
+type PageFetcher[T any] func(ctx context.Context, offset int, limit int) (*Paging[T], error)
+
+// AllPagesConcurrent uses the total from first to fetch every remaining page in
+// parallel, with at most concurrency requests in flight, and returns all items in
+// their original order. The first failed page cancels the rest.
+func AllPagesConcurrent[T any](ctx context.Context, first *Paging[T], fetch PageFetcher[T], concurrency int) ([]T, error) {
+	limit := first.Limit
+	if limit <= 0 {
+		limit = len(first.Items)
+	}
+	if first.Next == "" || limit == 0 {
+		return append([]T{}, first.Items...), nil
+	}
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	// Offsets of every page after the first one
+	offsets := []int{}
+	for offset := first.Offset + limit; offset < first.Total; offset += limit {
+		offsets = append(offsets, offset)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	pages := make([][]T, len(offsets))
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var firstErr error
+
+dispatch:
+	for i, offset := range offsets {
+		select {
+		case <-ctx.Done():
+			break dispatch
+		case slots <- struct{}{}:
+		}
+
+		wg.Add(1)
+		go func(i int, offset int) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+
+			page, err := fetch(ctx, offset, limit)
+			if err != nil {
+				errOnce.Do(func() {
+					firstErr = fmt.Errorf("error fetching page at offset %d: %w", offset, err)
+					cancel()
+				})
+				return
+			}
+			pages[i] = page.Items
+		}(i, offset)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// Reassemble in offset order
+	items := append(make([]T, 0, first.Total), first.Items...)
+	for _, page := range pages {
+		items = append(items, page...)
+	}
+
+	return items, nil
+}
@@ -0,0 +1,51 @@
+package spotify
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// idPattern matches Spotify's base62 object IDs
+var idPattern = regexp.MustCompile(`^[0-9A-Za-z]{22}$`)
+
+// ParsePlaylistID extracts a playlist ID from an open.spotify.com URL, a
+// spotify:playlist: URI (including the older spotify:user:<user>:playlist: form)
+// or a bare ID
+func ParsePlaylistID(input string) (string, error) {
+	input = strings.TrimSpace(input)
+
+	var id string
+	switch {
+	case strings.HasPrefix(input, "spotify:"):
+		parts := strings.Split(input, ":")
+		if len(parts) >= 3 && parts[len(parts)-2] == "playlist" {
+			id = parts[len(parts)-1]
+		}
+	case strings.Contains(input, "open.spotify.com"):
+		if !strings.Contains(input, "://") {
+			input = "https://" + input
+		}
+		u, err := url.Parse(input)
+		if err != nil {
+			return "", fmt.Errorf("invalid playlist URL: %v", err)
+		}
+
+		// Paths look like /playlist/{id}, with optional /intl-xx or /embed prefixes
+		parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+		for i := 0; i+1 < len(parts); i++ {
+			if parts[i] == "playlist" {
+				id = parts[i+1]
+				break
+			}
+		}
+	default:
+		id = input
+	}
+
+	if !idPattern.MatchString(id) {
+		return "", fmt.Errorf("not a Spotify playlist URL, URI or ID: %q", input)
+	}
+	return id, nil
+}
@@ -0,0 +1,81 @@
+package spotify
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket shared by every request a Client makes. It also
+// holds a pause, set when Spotify answers 429, so that one throttled request
+// backs off all of the others instead of each discovering the limit on its own.
+type RateLimiter struct {
+	mu          sync.Mutex
+	rate        float64 // tokens added per second
+	burst       float64
+	tokens      float64
+	last        time.Time
+	pausedUntil time.Time
+}
+
+// NewRateLimiter allows rate requests per second on average with bursts of up to burst
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Wait blocks until a request may be sent or ctx is done
+func (l *RateLimiter) Wait(ctx context.Context) error {
+	for {
+		delay := l.reserve()
+		if delay <= 0 {
+			return nil
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// PauseUntil stops handing out tokens until t
+func (l *RateLimiter) PauseUntil(t time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if t.After(l.pausedUntil) {
+		l.pausedUntil = t
+	}
+}
+
+// reserve takes a token if one is available, otherwise returns how long to wait before trying again
+func (l *RateLimiter) reserve() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Before(l.pausedUntil) {
+		return l.pausedUntil.Sub(now)
+	}
+
+	// Refill for the time since the last reservation
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0
+	}
+	return time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+}
@@ -0,0 +1,190 @@
+package spotify
+
+// Image is a cover or profile image with its dimensions
+type Image struct {
+	URL    string `json:"url"`
+	Height int    `json:"height"`
+	Width  int    `json:"width"`
+}
+
+// ExternalURLs holds the open.spotify.com links for an object
+type ExternalURLs struct {
+	Spotify string `json:"spotify"`
+}
+
+// User is a Spotify user profile
+type User struct {
+	ID           string       `json:"id"`
+	DisplayName  string       `json:"display_name"`
+	Email        string       `json:"email,omitempty"`
+	Country      string       `json:"country,omitempty"`
+	Product      string       `json:"product,omitempty"`
+	Images       []Image      `json:"images"`
+	ExternalURLs ExternalURLs `json:"external_urls"`
+	URI          string       `json:"uri"`
+}
+
+// PlaylistTracksRef is the track summary embedded in a playlist object
+type PlaylistTracksRef struct {
+	Href  string `json:"href"`
+	Total int    `json:"total"`
+}
+
+// Playlist is a simplified playlist object
+type Playlist struct {
+	ID            string            `json:"id"`
+	Name          string            `json:"name"`
+	Description   string            `json:"description"`
+	Public        bool              `json:"public"`
+	Collaborative bool              `json:"collaborative"`
+	SnapshotID    string            `json:"snapshot_id"`
+	Images        []Image           `json:"images"`
+	Owner         User              `json:"owner"`
+	Tracks        PlaylistTracksRef `json:"tracks"`
+	ExternalURLs  ExternalURLs      `json:"external_urls"`
+	URI           string            `json:"uri"`
+}
+
+// Artist is a simplified artist object
+type Artist struct {
+	ID           string       `json:"id"`
+	Name         string       `json:"name"`
+	Href         string       `json:"href,omitempty"`
+	Images       []Image      `json:"images,omitempty"`
+	Genres       []string     `json:"genres,omitempty"`
+	ExternalURLs ExternalURLs `json:"external_urls"`
+	URI          string       `json:"uri"`
+}
+
+// Album is a simplified album object
+type Album struct {
+	ID          string   `json:"id"`
+	Name        string   `json:"name"`
+	Href        string   `json:"href"`
+	AlbumType   string   `json:"album_type,omitempty"`
+	ReleaseDate string   `json:"release_date,omitempty"`
+	Images      []Image  `json:"images"`
+	Artists     []Artist `json:"artists,omitempty"`
+	URI         string   `json:"uri,omitempty"`
+}
+
+// Track is a track object
+type Track struct {
+	ID         string   `json:"id"`
+	Name       string   `json:"name"`
+	DurationMs int      `json:"duration_ms"`
+	Album      Album    `json:"album"`
+	Artists    []Artist `json:"artists,omitempty"`
+	URI        string   `json:"uri"`
+}
+
+// PlaylistTrack is one entry of a playlist. Track is nil for removed or local items.
+type PlaylistTrack struct {
+	AddedAt string `json:"added_at"`
+	Track   *Track `json:"track"`
+}
+
+// Paging is one page of a paginated response
+type Paging[T any] struct {
+	Href     string `json:"href"`
+	Items    []T    `json:"items"`
+	Limit    int    `json:"limit"`
+	Next     string `json:"next"`
+	Offset   int    `json:"offset"`
+	Previous string `json:"previous"`
+	Total    int    `json:"total"`
+}
+
+// PlaylistTrackAlbumFields asks Spotify for only what ThinPlaylistTrack decodes, leaving
+// out markets, artists, preview URLs and the rest of the full track objects
+const PlaylistTrackAlbumFields = "href,limit,next,offset,previous,total,items(track(id,name,uri,album(id,name,href,images)))"
+
+// ThinPlaylistTrack is a playlist entry fetched with PlaylistTrackAlbumFields
+type ThinPlaylistTrack struct {
+	Track *ThinTrack `json:"track"`
+}
+
+// ThinTrack is a track with only its ID, name, URI and album
+type ThinTrack struct {
+	ID    string    `json:"id"`
+	Name  string    `json:"name"`
+	URI   string    `json:"uri"`
+	Album ThinAlbum `json:"album"`
+}
+
+// ThinAlbum is an album with only its ID, name, href and images
+type ThinAlbum struct {
+	ID     string  `json:"id"`
+	Name   string  `json:"name"`
+	Href   string  `json:"href"`
+	Images []Image `json:"images"`
+}
+
+// ToTrack widens a thin track into a Track, leaving the fields that weren't fetched empty
+func (t ThinTrack) ToTrack() Track {
+	return Track{
+		ID:   t.ID,
+		Name: t.Name,
+		URI:  t.URI,
+		Album: Album{
+			ID:     t.Album.ID,
+			Name:   t.Album.Name,
+			Href:   t.Album.Href,
+			Images: t.Album.Images,
+		},
+	}
+}
+
+// SavedAlbum is an album in the user's library
+type SavedAlbum struct {
+	AddedAt string `json:"added_at"`
+	Album   Album  `json:"album"`
+}
+
+// SavedTrack is a track in the user's library
+type SavedTrack struct {
+	AddedAt string `json:"added_at"`
+	Track   Track  `json:"track"`
+}
+
+// SimpleTrack is a track listed under an album, which leaves the album out
+type SimpleTrack struct {
+	ID          string   `json:"id"`
+	Name        string   `json:"name"`
+	DurationMs  int      `json:"duration_ms"`
+	TrackNumber int      `json:"track_number"`
+	Artists     []Artist `json:"artists,omitempty"`
+	URI         string   `json:"uri"`
+}
+
+// PlayHistory is one play from the user's recently played tracks
+type PlayHistory struct {
+	Track    Track  `json:"track"`
+	PlayedAt string `json:"played_at"`
+}
+
+// Cursors mark the edges of a CursorPaging page, as Unix timestamps in milliseconds
+type Cursors struct {
+	After  string `json:"after"`
+	Before string `json:"before"`
+}
+
+// CursorPaging is a page of a time-ordered collection, which is walked with cursors
+// instead of offsets
+type CursorPaging[T any] struct {
+	Href    string  `json:"href"`
+	Items   []T     `json:"items"`
+	Limit   int     `json:"limit"`
+	Next    string  `json:"next"`
+	Cursors Cursors `json:"cursors"`
+}
+
+// CurrentlyPlaying is the state of the user's player. Item is nil when nothing is
+// playing, and only a Track when CurrentlyPlayingType is "track".
+type CurrentlyPlaying struct {
+	Timestamp            int64  `json:"timestamp"`
+	ProgressMs           int    `json:"progress_ms"`
+	IsPlaying            bool   `json:"is_playing"`
+	Item                 *Track `json:"item"`
+	CurrentlyPlayingType string `json:"currently_playing_type"`
+}
@@ -5,6 +5,9 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
 	"time"
 
 	"go.etcd.io/bbolt"
@@ -13,17 +16,147 @@ import (
 const (
 	// BucketName is the name of the bucket to store sessions
 	SessionBucket = "sessions"
+	// SessionExpiryBucket indexes each session's expiries, unencrypted, so expiring
+	// tokens can be found without decrypting every session
+	SessionExpiryBucket = "session_expiries"
 	// DBPath is the path to the bbolt database file
 	DBPath = "sessions.db"
-	// SessionExpiry is the default session expiry time
+	// SessionExpiry is how long a session lasts without being used
 	SessionExpiry = 24 * time.Hour
+	// SessionRenewInterval is how much of SessionExpiry gets used up before a request
+	// slides it forward again, which keeps renewals from writing on every request
+	SessionRenewInterval = 1 * time.Hour
+	// TokenRefreshMargin is how long before an access token expires it gets refreshed
+	TokenRefreshMargin = 5 * time.Minute
+	// TokenRefreshInterval is how often the background refresher looks for expiring tokens
+	TokenRefreshInterval = 1 * time.Minute
 )
 
 // Session represents a user session
 type Session struct {
-	ID        string               `json:"id"`
-	Token     SpotifyTokenResponse `json:"token"`
-	ExpiresAt time.Time            `json:"expires_at"`
+	ID    string               `json:"id"`
+	Token SpotifyTokenResponse `json:"token"`
+	// ExpiresAt is when the session ends, unless it is used again before then
+	ExpiresAt time.Time `json:"expires_at"`
+	// TokenExpiresAt is when the access token in Token stops working
+	TokenExpiresAt time.Time `json:"token_expires_at"`
+	// Renewed is set by GetSession when it slid ExpiresAt forward, so the cookie can follow
+	Renewed bool `json:"-"`
+}
+
+// sessionExpiry is a session's entry in SessionExpiryBucket. It holds no secrets,
+// only what RunTokenRefresher needs to pick the sessions to open.
+type sessionExpiry struct {
+	ExpiresAt      time.Time `json:"e"`
+	TokenExpiresAt time.Time `json:"t"`
+	Refreshable    bool      `json:"r"`
+}
+
+// putSessionExpiry writes the expiry index entry for session
+func putSessionExpiry(tx *bbolt.Tx, sessionID string, session Session) error {
+	data, err := json.Marshal(sessionExpiry{
+		ExpiresAt:      session.ExpiresAt,
+		TokenExpiresAt: session.TokenExpiresAt,
+		Refreshable:    session.Token.RefreshToken != "",
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(SessionExpiryBucket)).Put([]byte(sessionID), data)
+}
+
+// deleteSessionRecord removes a session along with its expiry index entry
+func deleteSessionRecord(tx *bbolt.Tx, sessionID string) error {
+	if err := tx.Bucket([]byte(SessionExpiryBucket)).Delete([]byte(sessionID)); err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(SessionBucket)).Delete([]byte(sessionID))
+}
+
+// IndexSessionExpiries adds expiry index entries for sessions stored before the index
+// existed, and drops entries whose session is gone. Returns how many were added.
+func IndexSessionExpiries(db *bbolt.DB) (int, error) {
+	count := 0
+	err := db.Update(func(tx *bbolt.Tx) error {
+		sessions := tx.Bucket([]byte(SessionBucket))
+		index := tx.Bucket([]byte(SessionExpiryBucket))
+
+		// Writing while iterating isn't allowed, so collect the changes first
+		missing := make(map[string]Session)
+		err := sessions.ForEach(func(k, v []byte) error {
+			if index.Get(k) != nil {
+				return nil
+			}
+			session, err := decodeSession(string(k), v)
+			if err != nil {
+				return nil // Left for CleanupExpiredSessions
+			}
+			missing[string(k)] = session
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		orphans := []string{}
+		err = index.ForEach(func(k, v []byte) error {
+			if sessions.Get(k) == nil {
+				orphans = append(orphans, string(k))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for sessionID, session := range missing {
+			if err := putSessionExpiry(tx, sessionID, session); err != nil {
+				return err
+			}
+		}
+		for _, sessionID := range orphans {
+			if err := index.Delete([]byte(sessionID)); err != nil {
+				return err
+			}
+		}
+		count = len(missing)
+		return nil
+	})
+
+	return count, err
+}
+
+// sessionLocks holds a mutex per session ID so a token is only refreshed once at a time
+var sessionLocks sync.Map
+
+// sessionCipher encrypts session values before they are written to bbolt
+var sessionCipher *SessionCipher
+
+// encodeSession serializes and encrypts a session for storage
+func encodeSession(session Session) ([]byte, error) {
+	sessionJSON, err := json.Marshal(session)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal session: %v", err)
+	}
+	return sessionCipher.Seal(session.ID, sessionJSON)
+}
+
+// decodeSession decrypts and deserializes a stored session
+func decodeSession(sessionID string, data []byte) (Session, error) {
+	var session Session
+	sessionJSON, _, err := sessionCipher.Open(sessionID, data)
+	if err != nil {
+		return session, err
+	}
+	if err := json.Unmarshal(sessionJSON, &session); err != nil {
+		return session, fmt.Errorf("could not unmarshal session: %v", err)
+	}
+
+	// Sessions from before the two expiries were split only tracked the token's
+	if session.TokenExpiresAt.IsZero() {
+		session.TokenExpiresAt = session.ExpiresAt
+		session.ExpiresAt = session.ExpiresAt.Add(SessionExpiry)
+	}
+	return session, nil
 }
 
 // InitDB initializes the database
@@ -33,11 +166,12 @@ func InitDB() (*bbolt.DB, error) {
 		return nil, fmt.Errorf("could not open db: %v", err)
 	}
 
-	// Create the sessions bucket if it doesn't exist
+	// Create the sessions and login state buckets if they don't exist
 	err = db.Update(func(tx *bbolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte(SessionBucket))
-		if err != nil {
-			return fmt.Errorf("could not create bucket: %v", err)
+		for _, bucket := range []string{SessionBucket, SessionExpiryBucket, OAuthStateBucket} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(bucket)); err != nil {
+				return fmt.Errorf("could not create bucket: %v", err)
+			}
 		}
 		return nil
 	})
@@ -65,23 +199,27 @@ func StoreSession(db *bbolt.DB, tokenResponse SpotifyTokenResponse) (string, err
 		return "", fmt.Errorf("could not generate session ID: %v", err)
 	}
 
-	expiresAt := time.Now().Add(time.Duration(tokenResponse.ExpiresIn) * time.Second)
+	now := time.Now()
 	session := Session{
-		ID:        sessionID,
-		Token:     tokenResponse,
-		ExpiresAt: expiresAt,
+		ID:             sessionID,
+		Token:          tokenResponse,
+		ExpiresAt:      now.Add(SessionExpiry),
+		TokenExpiresAt: now.Add(time.Duration(tokenResponse.ExpiresIn) * time.Second),
 	}
 
-	// Serialize the session to JSON
-	sessionJSON, err := json.Marshal(session)
+	// Serialize and encrypt the session
+	sessionJSON, err := encodeSession(session)
 	if err != nil {
-		return "", fmt.Errorf("could not marshal session: %v", err)
+		return "", err
 	}
 
 	// Store the session in the database
 	err = db.Update(func(tx *bbolt.Tx) error {
 		b := tx.Bucket([]byte(SessionBucket))
-		return b.Put([]byte(sessionID), sessionJSON)
+		if err := b.Put([]byte(sessionID), sessionJSON); err != nil {
+			return err
+		}
+		return putSessionExpiry(tx, sessionID, session)
 	})
 	if err != nil {
 		return "", fmt.Errorf("could not store session: %v", err)
@@ -90,8 +228,8 @@ func StoreSession(db *bbolt.DB, tokenResponse SpotifyTokenResponse) (string, err
 	return sessionID, nil
 }
 
-// GetSession retrieves a session from the database
-func GetSession(db *bbolt.DB, sessionID string) (*Session, error) {
+// readSession loads a session from the database as it is stored, without checking expiry
+func readSession(db *bbolt.DB, sessionID string) (*Session, error) {
 	var session Session
 
 	err := db.View(func(tx *bbolt.Tx) error {
@@ -101,100 +239,222 @@ func GetSession(db *bbolt.DB, sessionID string) (*Session, error) {
 			return fmt.Errorf("session not found")
 		}
 
-		return json.Unmarshal(sessionData, &session)
+		var err error
+		session, err = decodeSession(sessionID, sessionData)
+		return err
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	// Check if the session has expired
-	if time.Now().After(session.ExpiresAt) {
-		// If we have a refresh token, try to refresh the session
-		if session.Token.RefreshToken != "" {
-			refreshedToken, err := RefreshAccessToken(session.Token.RefreshToken)
-			if err == nil {
-				// Update the session with the new token
-				err = UpdateSession(db, sessionID, refreshedToken)
-				if err == nil {
-					// Get the updated session
-					return GetSession(db, sessionID)
-				}
-			}
-		}
-
-		// Delete the expired session if we couldn't refresh it
-		_ = db.Update(func(tx *bbolt.Tx) error {
-			b := tx.Bucket([]byte(SessionBucket))
-			return b.Delete([]byte(sessionID))
-		})
-		return nil, fmt.Errorf("session expired")
-	}
-
 	return &session, nil
 }
 
-// UpdateSession updates an existing session with a new token
-func UpdateSession(db *bbolt.DB, sessionID string, tokenResponse SpotifyTokenResponse) error {
-	// Retrieve the existing session to keep any data we want to preserve
+// modifySession reads a session, applies modify and writes it back in one transaction
+func modifySession(db *bbolt.DB, sessionID string, modify func(session *Session)) (*Session, error) {
 	var session Session
-	err := db.View(func(tx *bbolt.Tx) error {
+
+	err := db.Update(func(tx *bbolt.Tx) error {
 		b := tx.Bucket([]byte(SessionBucket))
 		sessionData := b.Get([]byte(sessionID))
 		if sessionData == nil {
 			return fmt.Errorf("session not found")
 		}
-		return json.Unmarshal(sessionData, &session)
+
+		var err error
+		session, err = decodeSession(sessionID, sessionData)
+		if err != nil {
+			return err
+		}
+
+		modify(&session)
+
+		// Serialize and encrypt the updated session
+		sessionJSON, err := encodeSession(session)
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte(sessionID), sessionJSON); err != nil {
+			return err
+		}
+		return putSessionExpiry(tx, sessionID, session)
 	})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// If the new token doesn't have a refresh token but the old one does, keep the old refresh token
-	if tokenResponse.RefreshToken == "" && session.Token.RefreshToken != "" {
-		tokenResponse.RefreshToken = session.Token.RefreshToken
+	return &session, nil
+}
+
+// GetSession retrieves a session from the database. Using a session slides its expiry
+// forward, and an access token that has already expired is refreshed on the spot.
+func GetSession(db *bbolt.DB, sessionID string) (*Session, error) {
+	session, err := readSession(db, sessionID)
+	if err != nil {
+		return nil, err
 	}
 
-	// Update the session with the new token
-	session.Token = tokenResponse
-	session.ExpiresAt = time.Now().Add(time.Duration(tokenResponse.ExpiresIn) * time.Second)
+	// Check if the session has expired
+	if time.Now().After(session.ExpiresAt) {
+		_ = DeleteSession(db, sessionID)
+		return nil, fmt.Errorf("session expired")
+	}
 
-	// Serialize the updated session
-	sessionJSON, err := json.Marshal(session)
+	// RunTokenRefresher normally gets to tokens before they expire, this only catches
+	// the ones it missed, e.g. while the server was down
+	if time.Now().After(session.TokenExpiresAt) {
+		session, err = RefreshSessionToken(db, sessionID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Slide the session's expiry forward, but only once a renewal is worth a write
+	if time.Until(session.ExpiresAt) < SessionExpiry-SessionRenewInterval {
+		renewed, err := modifySession(db, sessionID, func(session *Session) {
+			session.ExpiresAt = time.Now().Add(SessionExpiry)
+		})
+		if err != nil {
+			slog.Warn("Error renewing session", "err", err)
+		} else {
+			session = renewed
+			session.Renewed = true
+		}
+	}
+
+	return session, nil
+}
+
+// RefreshSessionToken swaps the session's access token for a new one if it expires
+// within TokenRefreshMargin. A session whose refresh token Spotify rejects has been
+// revoked and is deleted.
+func RefreshSessionToken(db *bbolt.DB, sessionID string) (*Session, error) {
+	lock, _ := sessionLocks.LoadOrStore(sessionID, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	// Another request or the background refresher may have just refreshed it
+	session, err := readSession(db, sessionID)
 	if err != nil {
-		return fmt.Errorf("could not marshal session: %v", err)
+		return nil, err
+	}
+	if time.Until(session.TokenExpiresAt) > TokenRefreshMargin {
+		return session, nil
+	}
+	if session.Token.RefreshToken == "" {
+		return nil, fmt.Errorf("session has no refresh token")
 	}
 
-	// Store the updated session
-	return db.Update(func(tx *bbolt.Tx) error {
-		b := tx.Bucket([]byte(SessionBucket))
-		return b.Put([]byte(sessionID), sessionJSON)
+	refreshedToken, err := RefreshAccessToken(session.Token.RefreshToken)
+	if err != nil {
+		if spotifyStatus(err) == http.StatusBadRequest {
+			_ = DeleteSession(db, sessionID)
+		}
+		return nil, fmt.Errorf("could not refresh token: %w", err)
+	}
+
+	return UpdateSession(db, sessionID, refreshedToken)
+}
+
+// UpdateSession updates an existing session with a new token
+func UpdateSession(db *bbolt.DB, sessionID string, tokenResponse SpotifyTokenResponse) (*Session, error) {
+	return modifySession(db, sessionID, func(session *Session) {
+		// If the new token doesn't have a refresh token but the old one does, keep the old refresh token
+		if tokenResponse.RefreshToken == "" && session.Token.RefreshToken != "" {
+			tokenResponse.RefreshToken = session.Token.RefreshToken
+		}
+
+		// Update the session with the new token
+		session.Token = tokenResponse
+		session.TokenExpiresAt = time.Now().Add(time.Duration(tokenResponse.ExpiresIn) * time.Second)
 	})
 }
 
 // DeleteSession removes a session from the database
 func DeleteSession(db *bbolt.DB, sessionID string) error {
+	sessionLocks.Delete(sessionID)
 	return db.Update(func(tx *bbolt.Tx) error {
-		b := tx.Bucket([]byte(SessionBucket))
-		return b.Delete([]byte(sessionID))
+		return deleteSessionRecord(tx, sessionID)
 	})
 }
 
-// CleanupExpiredSessions removes all expired sessions from the database
+// RunTokenRefresher refreshes access tokens shortly before they expire, so requests
+// never wait on a refresh
+func RunTokenRefresher(db *bbolt.DB) {
+	ticker := time.NewTicker(TokenRefreshInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		var expiringSessionIDs []string
+
+		// Find live sessions whose tokens are about to expire. The expiry index is read
+		// in the clear, only the sessions picked here get decrypted.
+		now := time.Now()
+		cutoff := now.Add(TokenRefreshMargin)
+		err := db.View(func(tx *bbolt.Tx) error {
+			b := tx.Bucket([]byte(SessionExpiryBucket))
+			return b.ForEach(func(k, v []byte) error {
+				var expiry sessionExpiry
+				if err := json.Unmarshal(v, &expiry); err != nil {
+					return nil // Skip invalid entries
+				}
+
+				if now.Before(expiry.ExpiresAt) && expiry.TokenExpiresAt.Before(cutoff) && expiry.Refreshable {
+					expiringSessionIDs = append(expiringSessionIDs, string(k))
+				}
+				return nil
+			})
+		})
+		if err != nil {
+			slog.Error("Error finding expiring tokens", "err", err)
+			continue
+		}
+
+		for _, sessionID := range expiringSessionIDs {
+			if _, err := RefreshSessionToken(db, sessionID); err != nil {
+				slog.Warn("Error refreshing session token", "session_id", sessionID, "err", err)
+			}
+		}
+	}
+}
+
+// unreadableSessions remembers when CleanupExpiredSessions first failed to decrypt each
+// session, e.g. after its key was dropped. Those can't be used or renewed, so once
+// SessionExpiry has passed since then they are past any expiry they could have had.
+var (
+	unreadableSessions   = make(map[string]time.Time)
+	unreadableSessionsMu sync.Mutex
+)
+
+// CleanupExpiredSessions removes all expired sessions from the database, along with
+// ones that have been unreadable for longer than a session can live
 func CleanupExpiredSessions(db *bbolt.DB) error {
-	fmt.Println("Cleaning up expired sessions")
+	slog.Debug("Cleaning up expired sessions")
 	var expiredSessionIDs []string
 
+	unreadableSessionsMu.Lock()
+	defer unreadableSessionsMu.Unlock()
+
 	// Find all expired sessions
+	now := time.Now()
+	seen := make(map[string]bool)
 	err := db.View(func(tx *bbolt.Tx) error {
 		b := tx.Bucket([]byte(SessionBucket))
 		return b.ForEach(func(k, v []byte) error {
-			var session Session
-			if err := json.Unmarshal(v, &session); err != nil {
-				return nil // Skip invalid sessions
+			sessionID := string(k)
+			session, err := decodeSession(sessionID, v)
+			if err != nil {
+				seen[sessionID] = true
+				firstSeen, ok := unreadableSessions[sessionID]
+				if !ok {
+					unreadableSessions[sessionID] = now
+				} else if now.Sub(firstSeen) > SessionExpiry {
+					expiredSessionIDs = append(expiredSessionIDs, sessionID)
+				}
+				return nil
 			}
 
-			if time.Now().After(session.ExpiresAt) {
-				expiredSessionIDs = append(expiredSessionIDs, session.ID)
+			if now.After(session.ExpiresAt) {
+				expiredSessionIDs = append(expiredSessionIDs, sessionID)
 			}
 			return nil
 		})
@@ -203,14 +463,29 @@ func CleanupExpiredSessions(db *bbolt.DB) error {
 		return err
 	}
 
+	// Forget sessions that are gone or readable again, e.g. once their key is back
+	for sessionID := range unreadableSessions {
+		if !seen[sessionID] {
+			delete(unreadableSessions, sessionID)
+		}
+	}
+
 	// Delete all expired sessions
-	return db.Update(func(tx *bbolt.Tx) error {
-		b := tx.Bucket([]byte(SessionBucket))
+	err = db.Update(func(tx *bbolt.Tx) error {
 		for _, id := range expiredSessionIDs {
-			if err := b.Delete([]byte(id)); err != nil {
+			if err := deleteSessionRecord(tx, id); err != nil {
 				return err
 			}
 		}
 		return nil
 	})
-}
\ No newline at end of file
+	if err != nil {
+		return err
+	}
+
+	for _, id := range expiredSessionIDs {
+		sessionLocks.Delete(id)
+		delete(unreadableSessions, id)
+	}
+	return nil
+}
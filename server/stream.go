@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// StreamSummary is the final event of a playlist stream
+type StreamSummary struct {
+	Total     int   `json:"total"`
+	CacheHits int   `json:"cacheHits"`
+	ElapsedMs int64 `json:"elapsedMs"`
+}
+
+// streamedItem pairs a processed item with whether it came from the cache
+type streamedItem struct {
+	item   ProcessedItem
+	cached bool
+}
+
+// sseWriter writes Server-Sent Events and flushes each one immediately
+type sseWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+func newSSEWriter(w http.ResponseWriter) (*sseWriter, bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, false
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// Stop nginx style proxies from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	return &sseWriter{w: w, flusher: flusher}, true
+}
+
+// Send writes one event with a JSON encoded payload
+func (s *sseWriter) Send(event string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+// Ping writes a comment line, which keeps idle streams from being timed out by proxies
+func (s *sseWriter) Ping() error {
+	if _, err := fmt.Fprint(s.w, ": ping\n\n"); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+// Handler for /playlist/{playlistId}/stream, the streaming variant of /playlist/{playlistId}.
+// Emits a "meta" event with the album count, one "item" event per ProcessedItem as soon
+// as it is ready (cache hits first), then a "done" event with a StreamSummary.
+// Failures after the stream starts are sent as an "error" event.
+func playlistTracksStream(w http.ResponseWriter, r *http.Request, playlistID string, accessToken string) {
+	loggerFrom(r.Context()).Debug("Running handler", "handler", "/playlist/{playlistId}/stream")
+	start := time.Now()
+
+	sse, ok := newSSEWriter(w)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	trackItems, err := GetPlaylistAlbumTracks(r.Context(), playlistID, accessToken)
+	if err != nil {
+		loggerFrom(r.Context()).Error("Error getting playlist tracks", "err", err)
+		sse.Send("error", map[string]string{"error": "Failed to fetch playlist tracks"})
+		return
+	}
+	if err := sse.Send("meta", map[string]int{"total": len(trackItems)}); err != nil {
+		return
+	}
+
+	// Processing hands results over from many goroutines, funnel them to this one for writing
+	results := make(chan streamedItem, len(trackItems))
+	go func() {
+		ProcessItems(r.Context(), trackItems, func(i int, item ProcessedItem, cached bool) {
+			results <- streamedItem{item: item, cached: cached}
+		})
+		close(results)
+	}()
+
+	summary := StreamSummary{}
+	for {
+		select {
+		case <-r.Context().Done():
+			loggerFrom(r.Context()).Debug("Client disconnected from playlist stream")
+			return
+		case result, ok := <-results:
+			if !ok {
+				summary.ElapsedMs = time.Since(start).Milliseconds()
+				sse.Send("done", summary)
+				return
+			}
+
+			summary.Total++
+			if result.cached {
+				summary.CacheHits++
+			}
+			if err := sse.Send("item", result.item); err != nil {
+				loggerFrom(r.Context()).Debug("Error writing stream event", "err", err)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"slices"
+	"time"
+
+	"spotify-vis/spotify"
+)
+
+// TopItemsLimit is how many top tracks and artists are fetched per time range
+const TopItemsLimit = 50
+
+// TopProfile is the user's top tracks and artists over one time range, with the
+// palette their covers add up to
+type TopProfile struct {
+	TimeRange string          `json:"timeRange"`
+	Tracks    []ProcessedItem `json:"tracks"`
+	Artists   []ProcessedItem `json:"artists"`
+	Palette   []PaletteColor  `json:"palette"`
+}
+
+// NewArtistTrackItem builds a TrackItem for an artist so its photo can go through
+// the same image pipeline as album covers. Artist and album IDs never collide, so
+// the artist ID doubles as the cache key.
+func NewArtistTrackItem(artist spotify.Artist) TrackItem {
+	return TrackItem{
+		Album: AlbumItem{
+			ID:     artist.ID,
+			Name:   artist.Name,
+			URL:    artist.Href,
+			Images: artist.Images,
+		},
+	}
+}
+
+// GetTopProfile fetches the current user's top tracks and artists over timeRange
+// and processes their covers and photos together
+func GetTopProfile(ctx context.Context, accessToken string, timeRange string) (*TopProfile, error) {
+	// Spotify only ranks a user's top 50 or so, so one page is enough
+	tracks, err := spotifyClient.TopTracks(ctx, accessToken, timeRange, 0, TopItemsLimit)
+	if err != nil {
+		return nil, err
+	}
+	artists, err := spotifyClient.TopArtists(ctx, accessToken, timeRange, 0, TopItemsLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	trackItems := UniqueAlbumTracks(tracks.Items)
+	items := slices.Clone(trackItems)
+	for _, artist := range artists.Items {
+		items = append(items, NewArtistTrackItem(artist))
+	}
+
+	processedItems := HandoffItemsForImageProcessing(ctx, items)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	profile := &TopProfile{
+		TimeRange: timeRange,
+		Tracks:    processedItems[:len(trackItems)],
+		Artists:   processedItems[len(trackItems):],
+	}
+
+	// The profile's palette comes from the album covers, artist photos are mostly skin and backdrops
+	palettes := make([][]PaletteColor, len(profile.Tracks))
+	for i, item := range profile.Tracks {
+		palettes[i] = item.Palette
+	}
+	profile.Palette = AggregatePalette(palettes, PaletteSize)
+
+	return profile, nil
+}
+
+// Endpoint handler for /top, optionally limited to one time_range
+func topColors(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	loggerFrom(r.Context()).Debug("Running handler", "handler", "/top")
+
+	// Add CORS headers
+	w.Header().Set("Access-Control-Allow-Origin", os.Getenv("FRONTEND_URL"))
+	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+
+	// Handle preflight OPTIONS request
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	timeRanges := spotify.TimeRanges
+	if timeRange := r.URL.Query().Get("time_range"); timeRange != "" {
+		if !slices.Contains(spotify.TimeRanges, timeRange) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": "time_range must be short_term, medium_term or long_term"}`))
+			return
+		}
+		timeRanges = []string{timeRange}
+	}
+
+	session, ok := requireSession(w, r)
+	if !ok {
+		return
+	}
+
+	profiles := make([]*TopProfile, len(timeRanges))
+	for i, timeRange := range timeRanges {
+		profile, err := GetTopProfile(r.Context(), session.Token.AccessToken, timeRange)
+		if err != nil {
+			loggerFrom(r.Context()).Error("Error getting top items", "time_range", timeRange, "err", err)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error": "Failed to fetch top items"}`))
+			return
+		}
+		profiles[i] = profile
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(profiles)
+
+	loggerFrom(r.Context()).Debug("Top function finished", "elapsed", time.Since(start))
+}